@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -19,6 +20,7 @@ func main() {
 	mode := os.Args[1]
 
 	storageDir := "./data_crash"
+	ctx := context.Background()
 
 	if mode == "crash" {
 		fmt.Println("💥 STARTING CRASH MODE")
@@ -28,8 +30,16 @@ func main() {
 		repo, _ := db.NewLSMRepository(storageDir)
 
 		// 1. Insert Data
+		if err := repo.CreateDatabase(ctx, "agency"); err != nil {
+			log.Fatal(err)
+		}
+		if err := repo.CreateTable(ctx, "agency", domain.TableMetaData{Name: "users", Columns: []domain.ColumnDefinition{
+			{Name: "id", Type: "string"}, {Name: "name", Type: "string"}, {Name: "email", Type: "string"},
+		}}); err != nil {
+			log.Fatal(err)
+		}
 		row := domain.Row{"999", "SecretAgent", "topsecret@cia.gov"}
-		err := repo.InsertRow("users", row)
+		err := repo.InsertRow(ctx, "agency", "users", row)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -52,10 +62,10 @@ func main() {
 
 		// 2. Search for the lost key
 		fmt.Println("🔍 Searching for 'SecretAgent'...")
-		rows, _ := repo.Query("users", "999")
+		row, found, _ := repo.GetRow(ctx, "agency", "users", "999")
 
-		if len(rows) > 0 {
-			fmt.Printf("✅ FOUND: %v\n", rows[0])
+		if found {
+			fmt.Printf("✅ FOUND: %v\n", row)
 			fmt.Println("🎉 RECOVERY SUCCESSFUL! The WAL saved the data.")
 		} else {
 			fmt.Println("❌ DATA LOST! WAL recovery failed.")
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"chill-db/internal/db"
 	"chill-db/internal/domain"
@@ -17,6 +19,15 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to init repo: %v", err)
 	}
+	ctx := context.Background()
+	if err := repo.CreateDatabase(ctx, "test"); err != nil {
+		log.Fatalf("Create database failed: %v", err)
+	}
+	if err := repo.CreateTable(ctx, "test", domain.TableMetaData{Name: "users", Columns: []domain.ColumnDefinition{
+		{Name: "id", Type: "string"}, {Name: "name", Type: "string"}, {Name: "email", Type: "string"},
+	}}); err != nil {
+		log.Fatalf("Create table failed: %v", err)
+	}
 
 	// 2. Insert Data (Writes to WAL + MemTable)
 	fmt.Println(">> Inserting 5 rows...")
@@ -29,14 +40,14 @@ func main() {
 		row := domain.Row{id, name, email}
 
 		// Insert
-		if err := repo.InsertRow("users", row); err != nil {
+		if err := repo.InsertRow(ctx, "test", "users", row); err != nil {
 			log.Fatalf("Insert failed: %v", err)
 		}
-		fmt.Printf("   Inserted Key: users:%s\n", id)
+		fmt.Printf("   Inserted Row: test.users[%s]\n", id)
 	}
 
 	// 3. Verify WAL exists
-	if _, err := os.Stat("./data_test/wal.log"); err == nil {
+	if segments, _ := filepath.Glob("./data_test/wal_*.log"); len(segments) > 0 {
 		fmt.Println("✅ WAL file created successfully.")
 	} else {
 		log.Fatalf("❌ WAL file missing!")
@@ -52,7 +63,7 @@ func main() {
 	files, _ := os.ReadDir("./data_test")
 	sstCount := 0
 	for _, f := range files {
-		if f.Name() != "wal.log" {
+		if filepath.Ext(f.Name()) == ".db" {
 			fmt.Printf("✅ Found SSTable: %s\n", f.Name())
 			sstCount++
 		}
@@ -1,106 +1,169 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"chill-db/internal/api"
 	"chill-db/internal/db"
-	"chill-db/internal/domain"
 )
 
+// Every flag can also be set from the environment (flags win), which is handy in containers:
+//
+//	CHILLDB_ADDR=:9000 CHILLDB_ENGINE=lsm CHILLDB_DATA_DIR=/var/lib/chill-db go run ./cmd/server
 func main() {
-	// 1. Cleanup previous runs (Optional, for clean slate)
-	os.RemoveAll("./data_stress")
-
-	// 2. Initialize Repo
-	fmt.Println("🚀 Initializing LSM Engine...")
-	repo, err := db.NewLSMRepository("./data_stress")
+	addr := flag.String("addr", envOr("CHILLDB_ADDR", ":8080"), "HTTP listen address")
+	dataDir := flag.String("data", envOr("CHILLDB_DATA_DIR", "./data"), "data directory")
+	engine := flag.String("engine", envOr("CHILLDB_ENGINE", "lsm"), "storage engine: file or lsm")
+	compactEvery := flag.Duration("compact-interval", envDuration("CHILLDB_COMPACT_INTERVAL", 30*time.Second), "LSM compaction check interval (compaction also runs after every flush; 0 disables the worker)")
+	memTableSize := flag.Int("memtable-size", envInt("CHILLDB_MEMTABLE_SIZE", db.DefaultMemTableSize), "LSM MemTable flush threshold in bytes")
+	walSync := flag.String("wal-sync", envOr("CHILLDB_WAL_SYNC", "always"), "LSM WAL fsync policy: always, none, or an interval like 100ms")
+	compaction := flag.String("compaction", envOr("CHILLDB_COMPACTION", "leveled"), "LSM compaction strategy: leveled or tiered")
+	compression := flag.String("compression", envOr("CHILLDB_COMPRESSION", "snappy"), "LSM SSTable block compression: snappy, none or flate")
+	blockCache := flag.Int("block-cache", envInt("CHILLDB_BLOCK_CACHE", db.DefaultBlockCacheSize), "LSM block cache size in bytes (negative disables it)")
+	maxOpenFiles := flag.Int("max-open-files", envInt("CHILLDB_MAX_OPEN_FILES", db.DefaultMaxOpenFiles), "LSM limit on open SSTable files")
+	mmapReads := flag.Bool("mmap", envBool("CHILLDB_MMAP", false), "LSM: serve SSTable reads from memory-mapped files (64-bit Unix)")
+	prefixBloom := flag.String("prefix-bloom", envOr("CHILLDB_PREFIX_BLOOM", "none"), "LSM prefixes added to SSTable Bloom filters: none, table, or table+N (table plus N primary key bytes)")
+	flag.Parse()
+
+	syncMode, syncInterval, err := db.ParseSyncPolicy(*walSync)
 	if err != nil {
-		log.Fatalf("Init failed: %v", err)
+		log.Fatal(err)
+	}
+	strategy, err := db.ParseCompactionStrategy(*compaction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	codec, err := db.ParseCompression(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	extractor, err := db.ParsePrefixExtractor(*prefixBloom)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := db.Options{MemTableSize: *memTableSize, SyncMode: syncMode, SyncInterval: syncInterval, Compaction: strategy, Compression: codec,
+		BlockCacheSize: int64(*blockCache), MaxOpenFiles: *maxOpenFiles, MmapReads: *mmapReads,
+		PrefixExtractor: extractor}
+	repo, shutdownRepo, err := openRepository(*engine, *dataDir, opts, *compactEvery)
+	if err != nil {
+		log.Fatalf("Failed to open %s engine at %s: %v", *engine, *dataDir, err)
 	}
 
-	// 3. Create Fragmentation (Make 4 SSTables)
-	// We insert duplicate keys to test that Compaction correctly keeps the LATEST value.
-	ids := []string{"1", "2", "3"}
-
-	for i := 1; i <= 4; i++ {
-		fmt.Printf("\n--- Batch %d (Writing & Flushing) ---\n", i)
+	handler := api.NewHandler(repo)
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           handler.Routes(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
 
-		for _, id := range ids {
-			// Update the name each time: User1_v1, User1_v2, etc.
-			// This proves that Compaction keeps the newest version.
-			name := fmt.Sprintf("User%s_v%d", id, i)
-			row := domain.Row{id, name, "test@mail.com"} // Assuming Row is []string{"id", "name", "email"}
+	// Stop on Ctrl+C (SIGINT) or SIGTERM (docker stop, systemd, k8s)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-			if err := repo.InsertRow("users", row); err != nil {
-				log.Fatalf("Insert failed: %v", err)
-			}
-		}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("❄️  Chill-DB listening on %s (engine=%s, data=%s)", *addr, *engine, *dataDir)
+		serveErr <- server.ListenAndServe()
+	}()
 
-		// Force Flush to disk immediately to create a new .db file
-		if err := repo.Flush(); err != nil {
-			log.Fatalf("Flush failed: %v", err)
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Server error: %v", err)
 		}
-
-		countFiles("./data_stress")
-		time.Sleep(500 * time.Millisecond) // Slight delay to ensure distinct timestamps
+	case <-ctx.Done():
+		log.Println("Shutting down...")
 	}
 
-	// 4. Verify Data BEFORE Compaction
-	fmt.Println("\n🔍 Reading User:1 (Expect 'User1_v4')...")
-	rows, _ := repo.Query("users", "1")
-	if len(rows) > 0 {
-		fmt.Printf("   Found: %v (Correct)\n", rows[0])
-	} else {
-		log.Fatal("❌ Data missing before compaction!")
+	// Let in-flight requests finish before touching the storage engine
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
 	}
 
-	// 5. Start Compaction (Fast interval for testing)
-	fmt.Println("\n🧹 Starting Compaction Worker (2s interval)...")
-	repo.StartCompactionWorker(2 * time.Second)
+	if err := shutdownRepo(); err != nil {
+		log.Fatalf("Storage shutdown failed: %v", err)
+	}
+	log.Println("Bye 👋")
+}
 
-	// Wait for compaction to kick in (Loop check)
-	fmt.Println("⏳ Waiting for compaction to merge files...")
-	for {
-		time.Sleep(1 * time.Second)
-		count := countFiles("./data_stress")
+// openRepository builds the chosen engine and returns a func that shuts it down cleanly.
+func openRepository(engine, dataDir string, opts db.Options, compactEvery time.Duration) (db.Repository, func() error, error) {
+	switch engine {
+	case "file":
+		repo, err := db.NewFileRepository(dataDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		// CSV writes go straight to disk, nothing to flush
+		return repo, func() error { return nil }, nil
 
-		// If we are down to 1 .db file (plus wal.log), compaction worked!
-		if count == 1 {
-			fmt.Println("\n✅ COMPACTION FINISHED! Disk is clean.")
-			break
+	case "lsm":
+		repo, err := db.NewLSMRepositoryWithOptions(dataDir, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if compactEvery > 0 {
+			repo.StartCompactionWorker(compactEvery)
 		}
+		return repo, func() error {
+			// Flush the MemTable so the next start doesn't need a WAL replay, then close the WAL
+			if err := repo.Flush(); err != nil {
+				repo.Close()
+				return fmt.Errorf("flush: %w", err)
+			}
+			return repo.Close()
+		}, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown engine %q (want file or lsm)", engine)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return fallback
+}
 
-	// 6. Verify Data AFTER Compaction
-	// This is the critical test: Did we lose data during the merge?
-	fmt.Println("\n🔍 Reading User:1 AFTER Compaction...")
-	rows, _ = repo.Query("users", "1")
-	if len(rows) > 0 {
-		fmt.Printf("   Found: %v\n", rows[0])
-
-		// Check if it's the latest version (v4)
-		// Note: You'll need to adjust this check based on your exact Row structure
-		// fmt.Println("   (Verify this is 'User1_v4')")
-	} else {
-		log.Fatal("❌ CRITICAL: Data lost after compaction!")
+func envInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("Ignoring invalid %s=%q", key, v)
 	}
+	return fallback
+}
 
-	fmt.Println("\n🎉 Test Passed: LSM Engine works correctly.")
+func envBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+		log.Printf("Ignoring invalid %s=%q", key, v)
+	}
+	return fallback
 }
 
-// Helper to count .db files
-func countFiles(dir string) int {
-	files, _ := os.ReadDir(dir)
-	count := 0
-	for _, f := range files {
-		if filepath.Ext(f.Name()) == ".db" {
-			count++
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
 		}
+		log.Printf("Ignoring invalid %s=%q", key, v)
 	}
-	fmt.Printf("   [Disk Status] %d SSTables found.\n", count)
-	return count
+	return fallback
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -21,6 +22,15 @@ func main() {
 	if err != nil {
 		log.Fatalf("Init failed: %v", err)
 	}
+	ctx := context.Background()
+	if err := repo.CreateDatabase(ctx, "stress"); err != nil {
+		log.Fatalf("Create database failed: %v", err)
+	}
+	if err := repo.CreateTable(ctx, "stress", domain.TableMetaData{Name: "users", Columns: []domain.ColumnDefinition{
+		{Name: "id", Type: "string"}, {Name: "name", Type: "string"}, {Name: "email", Type: "string"},
+	}}); err != nil {
+		log.Fatalf("Create table failed: %v", err)
+	}
 
 	// 3. Create Fragmentation (Make 4 SSTables)
 	// We insert duplicate keys to test that Compaction correctly keeps the LATEST value.
@@ -35,7 +45,7 @@ func main() {
 			name := fmt.Sprintf("User%s_v%d", id, i)
 			row := domain.Row{id, name, "test@mail.com"} // Assuming Row is []string{"id", "name", "email"}
 
-			if err := repo.InsertRow("users", row); err != nil {
+			if err := repo.InsertRow(ctx, "stress", "users", row); err != nil {
 				log.Fatalf("Insert failed: %v", err)
 			}
 		}
@@ -51,9 +61,9 @@ func main() {
 
 	// 4. Verify Data BEFORE Compaction
 	fmt.Println("\n🔍 Reading User:1 (Expect 'User1_v4')...")
-	rows, _ := repo.Query("users", "1")
-	if len(rows) > 0 {
-		fmt.Printf("   Found: %v (Correct)\n", rows[0])
+	row, found, _ := repo.GetRow(ctx, "stress", "users", "1")
+	if found {
+		fmt.Printf("   Found: %v (Correct)\n", row)
 	} else {
 		log.Fatal("❌ Data missing before compaction!")
 	}
@@ -78,9 +88,9 @@ func main() {
 	// 6. Verify Data AFTER Compaction
 	// This is the critical test: Did we lose data during the merge?
 	fmt.Println("\n🔍 Reading User:1 AFTER Compaction...")
-	rows, _ = repo.Query("users", "1")
-	if len(rows) > 0 {
-		fmt.Printf("   Found: %v\n", rows[0])
+	row, found, _ = repo.GetRow(ctx, "stress", "users", "1")
+	if found {
+		fmt.Printf("   Found: %v\n", row)
 
 		// Check if it's the latest version (v4)
 		// Note: You'll need to adjust this check based on your exact Row structure
@@ -15,6 +15,16 @@ func NewHandler(repo db.Repository) *Handler { // NewHandler is the constructor/
 	return &Handler{Repo: repo}
 }
 
+// Routes wires every endpoint onto a fresh mux, so cmd/server and the tests serve the same API.
+func (h *Handler) Routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/database/create", h.CreateDatabase)
+	mux.HandleFunc("/database/drop", h.DropDatabase)
+	mux.HandleFunc("/databases", h.ListDatabases)
+	mux.HandleFunc("/sql", h.HandleSQL)
+	return mux
+}
+
 type DBRequest struct { // DTO (Data Transfer Object)
 	Name string `json:"name"` // It specifically tells the Go JSON encoder/decoder: "When reading JSON, look for a key named name (lowercase) and map its value to this struct field."
 }
@@ -73,8 +83,8 @@ func (h *Handler) DropDatabase(w http.ResponseWriter, r *http.Request){
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("Database created successfully"))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Database dropped successfully"))
 }
 
 // ListDatabases handles GET /databases
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBatchEncodeRoundTrip(t *testing.T) {
+	b := NewWriteBatch()
+	b.Put("a", []byte("1"))
+	b.Delete("b")
+	b.Put("c", []byte{}) // an empty value is not a tombstone
+
+	got, err := decodeBatch(b.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != 3 {
+		t.Fatalf("decoded %d ops, want 3", got.Len())
+	}
+	for i, op := range got.ops {
+		want := b.ops[i]
+		if op.key != want.key || op.entry.Tombstone != want.entry.Tombstone || string(op.entry.Value) != string(want.entry.Value) {
+			t.Fatalf("op %d = %+v, want %+v", i, op, want)
+		}
+	}
+
+	if _, err := decodeBatch(b.encode()[:10]); err == nil {
+		t.Fatal("a truncated batch must not decode")
+	}
+}
+
+// A batch is one WAL record: if the crash tears it, none of its keys come back.
+func TestWriteBatchAtomicRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal_000001.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := NewWriteBatch()
+	first.Put("a", []byte("1"))
+	first.Put("b", []byte("2"))
+	if err := wal.AppendBatch(first); err != nil {
+		t.Fatal(err)
+	}
+	second := NewWriteBatch()
+	second.Delete("a")
+	second.Put("c", []byte("3"))
+	second.Put("d", []byte("4"))
+	if err := wal.AppendBatch(second); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	// Cut the last byte: "c" and "d" are intact on disk but the record as a whole is not
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	for key, want := range map[string]bool{"a": true, "b": true, "c": false, "d": false} {
+		if _, found, _ := repo.Get(key); found != want {
+			t.Errorf("%s found = %v, want %v", key, found, want)
+		}
+	}
+}
+
+func TestLSMRepositoryWriteBatch(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	if err := repo.put("x", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	b := NewWriteBatch()
+	b.Put("y", []byte("1"))
+	b.Delete("x")
+	b.Put("y", []byte("2")) // later ops in a batch win
+	if err := repo.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found, _ := repo.Get("x"); found {
+		t.Error("x should be deleted")
+	}
+	if v, _, _ := repo.Get("y"); string(v) != "2" {
+		t.Errorf("y = %q, want 2", v)
+	}
+}
@@ -2,17 +2,39 @@ package db
 
 import (
 	"chill-db/internal/domain"
+	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // Run with: go test -v -bench=. -benchmem
 
+var benchUsers = domain.TableMetaData{Name: "users", Columns: []domain.ColumnDefinition{
+	{Name: "id", Type: "string"}, {Name: "name", Type: "string"}, {Name: "email", Type: "string"},
+}}
+
+// newBenchRepo opens a fresh LSM repository with the "bench.users" table created.
+func newBenchRepo(tb testing.TB) *LSMRepository {
+	repo, err := NewLSMRepository(tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := repo.CreateDatabase(ctx, "bench"); err != nil {
+		tb.Fatal(err)
+	}
+	if err := repo.CreateTable(ctx, "bench", benchUsers); err != nil {
+		tb.Fatal(err)
+	}
+	return repo
+}
+
 func BenchmarkInsert(b *testing.B) {
-	dir := b.TempDir()
-	repo, _ := NewLSMRepository(dir)
+	repo := newBenchRepo(b)
 	defer repo.Close()
+	ctx := context.Background()
 
 	baseRow := domain.Row{"key", "BenchUser", "bench@test.com"}
 
@@ -26,7 +48,7 @@ func BenchmarkInsert(b *testing.B) {
 		key := fmt.Sprintf("key-%d", i)
 		row := baseRow
 		row[0] = key
-		if err := repo.InsertRow("users", row); err != nil {
+		if err := repo.InsertRow(ctx, "bench", "users", row); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -41,16 +63,40 @@ func BenchmarkInsert(b *testing.B) {
 	b.ReportMetric(opsPerSec, "ops/sec")
 }
 
+// Many goroutines inserting at once: group commit lets them share fsyncs.
+func BenchmarkInsertParallel(b *testing.B) {
+	repo := newBenchRepo(b)
+	defer repo.Close()
+	ctx := context.Background()
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("key-%d", next.Add(1))
+			if err := repo.InsertRow(ctx, "bench", "users", domain.Row{key, "BenchUser", "bench@test.com"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	wal := repo.wal
+	if groups := wal.groups.Load(); groups > 0 {
+		b.ReportMetric(float64(wal.records.Load())/float64(groups), "records/fsync")
+	}
+}
+
 func BenchmarkQuery(b *testing.B) {
-	dir := b.TempDir()
-	repo, _ := NewLSMRepository(dir)
+	repo := newBenchRepo(b)
 	defer repo.Close()
+	ctx := context.Background()
 
 	// Seed data (1,000 items)
 	// We use keys "0", "1", ... "999"
 	for i := 0; i < 1000; i++ {
 		key := fmt.Sprintf("%d", i)
-		_ = repo.InsertRow("users", domain.Row{key, "User", "email"})
+		_ = repo.InsertRow(ctx, "bench", "users", domain.Row{key, "User", "email"})
 	}
 	repo.Flush() // Force flush to disk so we test SSTables/BloomFilters
 
@@ -63,7 +109,7 @@ func BenchmarkQuery(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			// Query existing keys ("0" to "999")
 			key := fmt.Sprintf("%d", i%1000)
-			_, _ = repo.Query("users", key)
+			_, _, _ = repo.GetRow(ctx, "bench", "users", key)
 		}
 		elapsed := time.Since(start)
 		b.ReportMetric(float64(b.N)/elapsed.Seconds(), "reads/sec")
@@ -75,7 +121,7 @@ func BenchmarkQuery(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			// Query keys that definitely don't exist ("missing-0", etc.)
 			key := fmt.Sprintf("missing-%d", i)
-			_, _ = repo.Query("users", key)
+			_, _, _ = repo.GetRow(ctx, "bench", "users", key)
 		}
 		elapsed := time.Since(start)
 		b.ReportMetric(float64(b.N)/elapsed.Seconds(), "reads/sec")
@@ -89,8 +135,8 @@ func BenchmarkCompaction(b *testing.B) {
 		b.StopTimer() // --- PAUSE ---
 
 		// 1. SETUP: Create a fresh DB for every iteration
-		dir := b.TempDir()
-		repo, _ := NewLSMRepository(dir)
+		repo := newBenchRepo(b)
+		ctx := context.Background()
 
 		// 2. FRAGMENTATION: Create 5 files with 1000 keys each
 		const numFiles = 5
@@ -101,7 +147,7 @@ func BenchmarkCompaction(b *testing.B) {
 				key := fmt.Sprintf("key-%d", k)
 				// Create versioned values to ensure they differ
 				val := fmt.Sprintf("value-v%d", f)
-				repo.InsertRow("users", domain.Row{key, val, "email"})
+				repo.InsertRow(ctx, "bench", "users", domain.Row{key, val, "email"})
 			}
 			repo.Flush() // Force new SSTable
 		}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Block-based table layout (sstFormatBlock):
+//
+//	[data block 0] ... [data block n-1] [filter] [index block] [properties] [footer]
+//
+// A block is a run of entries followed by its restart array:
+//
+//	entry    = [shared uvarint][unshared uvarint][payloadLen uvarint][key[shared:]][payload]
+//	trailer  = [restart offset uint32]... [numRestarts uint32]
+//
+// Keys are prefix-compressed: each entry stores only what differs from the previous key.
+// Every blockRestartInterval entries the full key is stored again (shared = 0) and its offset
+// goes in the restart array, so a lookup binary-searches the restart points and decodes at
+// most one interval of entries.
+//
+// Data block payload:  [seq uvarint][kind byte: 0 value, 1 tombstone][value]
+// Index block payload: [offset uvarint][size uvarint], keyed by the last key of the data block.
+//
+// Data blocks are cut at Options.BlockSize (default 4 KiB). The versions of one key may
+// straddle two blocks: the index finds the first block whose last key is >= the search key,
+// which holds the newest version, and readers carry on into the next block for older ones.
+
+const (
+	blockRestartInterval = 16
+	blockKindValue       = 0
+	blockKindTombstone   = 1
+)
+
+var errBlockCorrupt = errors.New("corrupt block")
+
+// blockHandle locates a block inside the file.
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (h blockHandle) encode(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, h.offset)
+	return binary.AppendUvarint(buf, h.size)
+}
+
+func decodeBlockHandle(data []byte) (blockHandle, error) {
+	offset, n := binary.Uvarint(data)
+	if n <= 0 {
+		return blockHandle{}, errBlockCorrupt
+	}
+	size, m := binary.Uvarint(data[n:])
+	if m <= 0 {
+		return blockHandle{}, errBlockCorrupt
+	}
+	return blockHandle{offset: offset, size: size}, nil
+}
+
+// blockBuilder accumulates sorted entries into one block.
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	interval int
+	counter  int // entries since the last restart point
+	lastKey  string
+	entries  int
+}
+
+func newBlockBuilder(interval int) *blockBuilder {
+	return &blockBuilder{interval: interval}
+}
+
+func (b *blockBuilder) add(key string, payload []byte) {
+	shared := 0
+	if b.counter < b.interval && b.entries > 0 {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(payload)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, payload...)
+	b.lastKey = key
+	b.counter++
+	b.entries++
+}
+
+// estimatedSize is what finish would return the length of.
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// finish appends the restart array and returns the block. The builder is reset for reuse;
+// the returned slice is only valid until the next add.
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	out := b.buf
+	b.buf, b.restarts, b.counter, b.entries, b.lastKey = out[:0], b.restarts[:0], 0, 0, ""
+	return out
+}
+
+func encodeDataPayload(buf []byte, entry Entry) []byte {
+	buf = binary.AppendUvarint(buf, entry.Seq)
+	if entry.Tombstone {
+		return append(buf, blockKindTombstone)
+	}
+	buf = append(buf, blockKindValue)
+	return append(buf, entry.Value...)
+}
+
+func decodeDataPayload(payload []byte) (Entry, error) {
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 || n >= len(payload) {
+		return Entry{}, errBlockCorrupt
+	}
+	switch payload[n] {
+	case blockKindTombstone:
+		return Entry{Tombstone: true, Seq: seq}, nil
+	case blockKindValue:
+		return Entry{Value: payload[n+1:], Seq: seq}, nil
+	}
+	return Entry{}, errBlockCorrupt
+}
+
+// block is a decoded view of one block's bytes.
+type block struct {
+	data     []byte // the entries
+	restarts []byte // numRestarts x uint32
+}
+
+func parseBlock(raw []byte) (*block, error) {
+	if len(raw) < 4 {
+		return nil, errBlockCorrupt
+	}
+	n := int(binary.LittleEndian.Uint32(raw[len(raw)-4:]))
+	restartsStart := len(raw) - 4 - 4*n
+	if restartsStart < 0 || (n == 0 && restartsStart > 0) {
+		return nil, errBlockCorrupt
+	}
+	return &block{data: raw[:restartsStart], restarts: raw[restartsStart : len(raw)-4]}, nil
+}
+
+func (b *block) numRestarts() int { return len(b.restarts) / 4 }
+
+func (b *block) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(b.restarts[4*i:]))
+}
+
+// blockIter walks the entries of one block.
+type blockIter struct {
+	b       *block
+	next    int // offset of the entry after the current one
+	key     []byte
+	payload []byte
+	valid   bool
+	err     error
+}
+
+func newBlockIter(b *block) *blockIter { return &blockIter{b: b} }
+
+// decodeAt decodes the entry at offset off, whose shared prefix comes from it.key.
+func (it *blockIter) decodeAt(off int) bool {
+	it.valid = false
+	if off >= len(it.b.data) {
+		return false
+	}
+	data := it.b.data[off:]
+	shared, n1 := binary.Uvarint(data)
+	unshared, n2 := binary.Uvarint(data[max(n1, 0):])
+	payloadLen, n3 := binary.Uvarint(data[max(n1+n2, 0):])
+	head := n1 + n2 + n3
+	if n1 <= 0 || n2 <= 0 || n3 <= 0 || shared > uint64(len(it.key)) ||
+		uint64(len(data)-head) < unshared+payloadLen {
+		it.err = fmt.Errorf("%w: bad entry at offset %d", errBlockCorrupt, off)
+		return false
+	}
+	keyEnd := head + int(unshared)
+	it.key = append(it.key[:shared], data[head:keyEnd]...)
+	it.payload = data[keyEnd : keyEnd+int(payloadLen)]
+	it.next = off + keyEnd + int(payloadLen)
+	it.valid = true
+	return true
+}
+
+func (it *blockIter) seekToRestart(i int) bool {
+	it.key = it.key[:0]
+	if i >= it.b.numRestarts() { // empty block
+		it.valid = false
+		return false
+	}
+	return it.decodeAt(it.b.restart(i))
+}
+
+func (it *blockIter) SeekToFirst() { it.seekToRestart(0) }
+
+func (it *blockIter) Next() { it.decodeAt(it.next) }
+
+// Seek moves to the first entry whose key is >= key: a binary search over the restart
+// points for the last one before key, then a linear scan of at most one interval.
+func (it *blockIter) Seek(key string) {
+	// Restart keys are stored in full, so they decode on their own
+	i := sort.Search(it.b.numRestarts(), func(i int) bool {
+		return !it.seekToRestart(i) || string(it.key) >= key
+	})
+	if it.err != nil {
+		return
+	}
+	if i > 0 {
+		i-- // strictly before key: the entries of key may start before its restart point
+	}
+	for ok := it.seekToRestart(i); ok && string(it.key) < key; ok = it.valid {
+		it.Next()
+	}
+}
+
+func (it *blockIter) Valid() bool { return it.valid }
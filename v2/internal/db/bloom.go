@@ -3,83 +3,240 @@ package db
 import (
 	"encoding/binary"
 	"hash/fnv"
+	"math"
+	"math/bits"
 )
 
+// BloomFilter answers "might this table hold key?" without reading the table: false means
+// definitely not.
+//
+// Filters are sized from a target false-positive rate (NewBloomFilterFor) and probed with
+// double hashing: the two 64-bit halves h1, h2 of the key's 128-bit MurmurHash3 put probe i
+// at (h1 + i*h2) mod size. Flat tables adopted from older versions carry the legacy kind (one
+// FNV hash plus a fixed stride, so every key's probes collide together); those stay readable.
 type BloomFilter struct {
 	bitset    []byte
-	size      uint64
+	size      uint64 // in bits, never 0 for a filter that can answer no
 	hashCount uint64
+	version   byte
+	prefixes  string // name of the PrefixExtractor whose prefixes were added too, "" if none
 }
 
-func NewBloomFilter(size uint64, hashCount uint64) *BloomFilter {
-	// We need 'size' bits.
-	// Since 1 byte = 8 bits, we need size/8 bytes.
-	// We add 7 before dividing to round up (ceiling division).
-	byteSize := (size + 7) / 8
+// Filter encodings.
+const (
+	// [size u64][hashCount u64][bitset]: FNV-1a plus a fixed stride. Only ever decoded.
+	bloomVersionLegacy byte = 0
+	// [version u8][hashCount u8][size u64][bitset]: MurmurHash3 double hashing.
+	bloomVersionDouble byte = 1
+	// [version u8][hashCount u8][size u64][name len u8][extractor name][bitset]: the same,
+	// with the prefixes of a PrefixExtractor added as well.
+	bloomVersionPrefix byte = 2
+)
 
+// NewBloomFilter returns a filter of size bits probed hashCount times per key.
+func NewBloomFilter(size uint64, hashCount uint64) *BloomFilter {
+	// At least 64 bits: positions are taken modulo the size, and a filter for an
+	// empty table must still work (it just says no to everything)
+	size = max(size, 64)
 	return &BloomFilter{
-		bitset:    make([]byte, byteSize),
+		bitset:    make([]byte, (size+7)/8),
 		size:      size,
-		hashCount: hashCount,
+		hashCount: min(max(hashCount, 1), 255),
+		version:   bloomVersionDouble,
+	}
+}
+
+// NewBloomFilterFor sizes a filter for n keys at false-positive rate fpRate: -ln(p)/ln(2)²
+// bits per key and ln(2) probes per bit per key, the optimum for that size. 1% takes 9.6
+// bits and 7 probes per key.
+func NewBloomFilterFor(n int, fpRate float64) *BloomFilter {
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultBloomFPRate
 	}
+	bitsPerKey := -math.Log(fpRate) / (math.Ln2 * math.Ln2)
+	probes := uint64(math.Round(bitsPerKey * math.Ln2))
+	return NewBloomFilter(uint64(math.Ceil(float64(n)*bitsPerKey)), min(max(probes, 1), 30))
 }
 
 func (bf *BloomFilter) Add(key string) {
-	h := hash(key)
+	bf.addHash(bloomHash([]byte(key)))
+}
 
+// addHash sets the bits for a key whose hash is already computed.
+func (bf *BloomFilter) addHash(h1, h2 uint64) {
 	for i := uint64(0); i < bf.hashCount; i++ {
-		// SIMPLIFIED HASHING:
-		// Just add 'i' to the hash to get a "new" position
-		position := (h + (i * 0x9e3779b9)) % bf.size
-		byteIndex := position / 8
-		bitIndex := position % 8
-		// Turn ON the specific bit using bitwise OR (|)
-		bf.bitset[byteIndex] |= (1 << bitIndex)
+		pos := h1 % bf.size
+		bf.bitset[pos/8] |= 1 << (pos % 8)
+		h1 += h2
 	}
 }
 
 // Contains checks if a key MIGHT be in the set
 // Returns true if possibly present, false if definitely not.
 func (bf *BloomFilter) Contains(key []byte) bool {
-	h1 := hash(string(key))
+	if bf.size == 0 {
+		return true // a legacy filter without bits: it can't rule anything out
+	}
+	if bf.version == bloomVersionLegacy {
+		return bf.containsLegacy(key)
+	}
+	h1, h2 := bloomHash(key)
 	for i := uint64(0); i < bf.hashCount; i++ {
-		pos := (h1 + (i * 0x9e3779b9)) % bf.size
-		byteIndex := pos / 8
-		bitIndex := pos % 8
-		// Check if the bit is OFF
-		if (bf.bitset[byteIndex] & (1 << bitIndex)) == 0 {
+		pos := h1 % bf.size
+		if bf.bitset[pos/8]&(1<<(pos%8)) == 0 {
 			return false // Definitely not here
 		}
+		h1 += h2
 	}
 	return true // Possibly here
 }
 
-func hash(s string) uint64 {
+// containsLegacy probes the way filters were built before double hashing.
+func (bf *BloomFilter) containsLegacy(key []byte) bool {
 	h := fnv.New64a()
-	h.Write([]byte(s))
-	return h.Sum64()
+	h.Write(key)
+	h1 := h.Sum64()
+	for i := uint64(0); i < bf.hashCount; i++ {
+		pos := (h1 + (i * 0x9e3779b9)) % bf.size
+		if bf.bitset[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
 }
 
+// Encode writes [version][hashCount u8][size u64][bitset], with the extractor name before
+// the bitset if the filter holds prefixes.
 func (bf *BloomFilter) Encode() []byte {
-	buffer := make([]byte, 16+len(bf.bitset))
-	binary.LittleEndian.PutUint64(buffer[0:8], bf.size)
-	binary.LittleEndian.PutUint64(buffer[8:16], bf.hashCount)
-	copy(buffer[16:], bf.bitset)
-	return buffer
+	buffer := make([]byte, 10, 11+len(bf.prefixes)+len(bf.bitset))
+	buffer[0] = bloomVersionDouble
+	buffer[1] = byte(bf.hashCount)
+	binary.LittleEndian.PutUint64(buffer[2:10], bf.size)
+	if bf.prefixes != "" {
+		buffer[0] = bloomVersionPrefix
+		buffer = append(append(buffer, byte(len(bf.prefixes))), bf.prefixes...)
+	}
+	return append(buffer, bf.bitset...)
 }
 
+// DecodeBloomFilter reads what Encode wrote. nil if it doesn't hold together: an unknown
+// version, or a bitset that doesn't match the size.
 func DecodeBloomFilter(data []byte) *BloomFilter {
+	if len(data) < 10 || data[1] == 0 {
+		return nil
+	}
+	bf := &BloomFilter{hashCount: uint64(data[1]), version: bloomVersionDouble}
+	bf.size = binary.LittleEndian.Uint64(data[2:10])
+	rest := data[10:]
+	switch data[0] {
+	case bloomVersionDouble:
+	case bloomVersionPrefix:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil
+		}
+		bf.prefixes, rest = string(rest[1:1+rest[0]]), rest[1+rest[0]:]
+	default:
+		return nil
+	}
+	if bf.size == 0 || (bf.size+7)/8 != uint64(len(rest)) {
+		return nil
+	}
+	bf.bitset = append([]byte(nil), rest...)
+	return bf
+}
+
+// MayContainPrefix is Contains for a prefix extracted by pe: false if no key in the table
+// has it. Always true if the filter wasn't built with pe.
+func (bf *BloomFilter) MayContainPrefix(pe PrefixExtractor, prefix string) bool {
+	if pe == nil || bf.prefixes == "" || bf.prefixes != pe.Name() {
+		return true
+	}
+	return bf.Contains([]byte(prefix))
+}
+
+// decodeLegacyBloomFilter reads the filter of a flat table. nil if the bitset doesn't match the size.
+func decodeLegacyBloomFilter(data []byte) *BloomFilter {
 	if len(data) < 16 {
 		return nil
 	}
 	size := binary.LittleEndian.Uint64(data[0:8])
 	hashCount := binary.LittleEndian.Uint64(data[8:16])
 	// The rest of the data is the bitset
-	bitset := make([]byte, len(data)-16)
-	copy(bitset, data[16:])
+	if (size+7)/8 != uint64(len(data)-16) {
+		return nil
+	}
 	return &BloomFilter{
-		bitset:    bitset,
+		bitset:    append([]byte(nil), data[16:]...),
 		size:      size,
 		hashCount: hashCount,
+		version:   bloomVersionLegacy,
+	}
+}
+
+// FilterStats is what kept lookups and scans away from one table: its key range, and its
+// Bloom filter for keys the table doesn't hold and for prefix scans.
+type FilterStats struct {
+	Table          string
+	Level          int
+	Negatives      int64 // lookups the filter turned away without reading the table
+	FalsePositives int64 // lookups it let through, that read the table for nothing
+	PrefixSkips    int64 // prefix scans it left out (see PrefixExtractor)
+	RangeSkips     int64 // lookups and scans its key range left out, before the filter was asked
+}
+
+// FPRate is the observed false-positive rate: the share of lookups for missing keys that
+// still read the table. 0 until there have been any.
+func (s FilterStats) FPRate() float64 {
+	if n := s.Negatives + s.FalsePositives; n > 0 {
+		return float64(s.FalsePositives) / float64(n)
+	}
+	return 0
+}
+
+// bloomHash is the 128-bit MurmurHash3 (x64 variant, seed 0) of key, as two 64-bit halves.
+// Written out here so the filter format doesn't depend on a library.
+func bloomHash(key []byte) (uint64, uint64) {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+	var h1, h2 uint64
+	n := len(key)
+	for ; len(key) >= 16; key = key[16:] {
+		k1 := binary.LittleEndian.Uint64(key)
+		k2 := binary.LittleEndian.Uint64(key[8:])
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+		h1 = (bits.RotateLeft64(h1, 27)+h2)*5 + 0x52dce729
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+		h2 = (bits.RotateLeft64(h2, 31)+h1)*5 + 0x38495ab5
+	}
+	// The tail: up to 15 bytes, little-endian into k1 (first 8) and k2 (the rest)
+	var k1, k2 uint64
+	for i := len(key) - 1; i >= 8; i-- {
+		k2 = k2<<8 | uint64(key[i])
+	}
+	for i := min(len(key), 8) - 1; i >= 0; i-- {
+		k1 = k1<<8 | uint64(key[i])
 	}
+	if len(key) > 8 {
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+	}
+	if len(key) > 0 {
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1, h2 = fmix64(h1), fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return h1, h2
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
 }
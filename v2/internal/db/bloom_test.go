@@ -0,0 +1,122 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+// Reference values of MurmurHash3_x64_128 with seed 0, as the 16 bytes it outputs.
+func TestBloomHashVectors(t *testing.T) {
+	for key, want := range map[string]string{
+		"":      "00000000000000000000000000000000",
+		"hello": "029bbd41b3a7d8cb191dae486a901e5b",
+		"The quick brown fox jumps over the lazy dog": "6c1b07bc7bbc4be347939ac4a93c437a",
+	} {
+		h1, h2 := bloomHash([]byte(key))
+		var out [16]byte
+		binary.LittleEndian.PutUint64(out[:8], h1)
+		binary.LittleEndian.PutUint64(out[8:], h2)
+		if got := fmt.Sprintf("%x", out); got != want {
+			t.Errorf("bloomHash(%q) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+// The observed false-positive rate is close to the one the filter is sized for.
+func TestBloomFilterFPRate(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.01, 0.001} {
+		bf := NewBloomFilterFor(10000, rate)
+		for i := 0; i < 10000; i++ {
+			bf.Add(fmt.Sprintf("r:shop:users:%06d", i))
+		}
+		bf = DecodeBloomFilter(bf.Encode())
+		if bf == nil {
+			t.Fatal("filter didn't decode")
+		}
+		for i := 0; i < 10000; i++ {
+			if !bf.Contains([]byte(fmt.Sprintf("r:shop:users:%06d", i))) {
+				t.Fatalf("false negative for key %d", i)
+			}
+		}
+		fp := 0
+		const probes = 200000
+		for i := 0; i < probes; i++ {
+			if bf.Contains([]byte(fmt.Sprintf("r:shop:orders:%06d", i))) {
+				fp++
+			}
+		}
+		if got := float64(fp) / probes; got > rate*1.5 {
+			t.Errorf("sized for %v, observed %v", rate, got)
+		}
+	}
+}
+
+func TestBloomFilterEdgeCases(t *testing.T) {
+	// An empty table's filter says no to everything, and doesn't divide by zero doing it
+	empty := DecodeBloomFilter(NewBloomFilterFor(0, 0.01).Encode())
+	if empty == nil || empty.Contains([]byte("anything")) {
+		t.Fatal("empty filter doesn't reject")
+	}
+
+	for name, data := range map[string][]byte{
+		"short":        {bloomVersionDouble, 7},
+		"version":      append([]byte{9}, NewBloomFilter(64, 7).Encode()[1:]...),
+		"size":         NewBloomFilter(64, 7).Encode()[:12],
+		"zero size":    {bloomVersionDouble, 7, 0, 0, 0, 0, 0, 0, 0, 0},
+		"zero hashing": {bloomVersionDouble, 0, 64, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if DecodeBloomFilter(data) != nil {
+			t.Errorf("%s: decoded a damaged filter", name)
+		}
+	}
+
+	// A filter as flat tables carry it: FNV-1a plus a fixed stride
+	legacy := make([]byte, 16+2)
+	binary.LittleEndian.PutUint64(legacy[0:8], 10)
+	binary.LittleEndian.PutUint64(legacy[8:16], 7)
+	h := fnv.New64a()
+	h.Write([]byte("k"))
+	for i := uint64(0); i < 7; i++ {
+		pos := (h.Sum64() + i*0x9e3779b9) % 10
+		legacy[16+pos/8] |= 1 << (pos % 8)
+	}
+	bf := decodeLegacyBloomFilter(legacy)
+	if bf == nil || !bf.Contains([]byte("k")) {
+		t.Fatal("legacy filter doesn't find its key")
+	}
+	binary.LittleEndian.PutUint64(legacy[0:8], 0)
+	if decodeLegacyBloomFilter(legacy) != nil {
+		t.Fatal("legacy filter with a bitset that doesn't match its size decoded")
+	}
+}
+
+// Lookups for missing keys are counted per table: most turned away by the filter, a few not.
+func TestFilterStats(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{BloomFPRate: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for i := 0; i < 2000; i++ {
+		repo.put(fmt.Sprintf("key%05d", i*2), []byte("v"))
+	}
+	repo.Flush()
+	for i := 0; i < 2000; i++ {
+		if _, found, err := repo.Get(fmt.Sprintf("key%05d", i*2+1)); found || err != nil {
+			t.Fatalf("found a missing key: %v", err)
+		}
+	}
+	repo.Get("key00000") // found: counted nowhere
+
+	stats := repo.FilterStats()
+	if len(stats) != 1 {
+		t.Fatalf("stats for %d tables", len(stats))
+	}
+	s := stats[0]
+	// key03999 is past the table's last key: its key range turns it away before the filter
+	if s.RangeSkips != 1 || s.Negatives+s.FalsePositives != 1999 || s.FalsePositives == 0 || s.FPRate() > 0.1 {
+		t.Fatalf("stats %+v, rate %.3f", s, s.FPRate())
+	}
+}
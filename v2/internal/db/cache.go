@@ -0,0 +1,226 @@
+package db
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// blockKey names a data block: table number (unique within a repository) and offset.
+type blockKey struct {
+	table  uint64
+	offset uint64
+}
+
+// blockCache is an LRU of decoded (checksummed, decompressed, parsed) data blocks, shared by
+// every table of a repository and bounded by the bytes it holds. A hit costs a map lookup:
+// no syscall, no checksum, no decompression.
+//
+// Blocks of a retired table are not dropped eagerly: nobody asks for them again, so they
+// age out like any other cold block.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	lru      *list.List // of *cachedBlock, most recently used first
+	entries  map[blockKey]*list.Element
+
+	hits, misses atomic.Int64
+}
+
+type cachedBlock struct {
+	key    blockKey
+	b      *block
+	charge int64
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{capacity: capacity, lru: list.New(), entries: make(map[blockKey]*list.Element)}
+}
+
+func (c *blockCache) get(k blockKey) (*block, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[k]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return e.Value.(*cachedBlock).b, true
+}
+
+// add caches b, evicting the least recently used blocks to stay under capacity. Blocks are
+// immutable, so whoever still holds an evicted one keeps reading it safely.
+func (c *blockCache) add(k blockKey, b *block) {
+	charge := int64(len(b.data) + len(b.restarts) + 64) // 64: rough bookkeeping overhead
+	if charge > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[k]; ok {
+		return // another reader loaded it at the same time
+	}
+	c.entries[k] = c.lru.PushFront(&cachedBlock{key: k, b: b, charge: charge})
+	c.used += charge
+	for c.used > c.capacity {
+		oldest := c.lru.Back()
+		cb := oldest.Value.(*cachedBlock)
+		c.lru.Remove(oldest)
+		delete(c.entries, cb.key)
+		c.used -= cb.charge
+	}
+}
+
+func (c *blockCache) size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
+
+// tableHandle is an open table file, shared by every read of the table.
+type tableHandle struct {
+	f       *os.File
+	mapped  []byte // the whole file, with Options.MmapReads (nil if mapping failed: reads use pread)
+	num     uint64
+	refs    int  // reads using it, plus one while it is in the cache (guarded by tableCache.mu)
+	evicted bool // out of the cache: closed once the last read releases it
+	elem    *list.Element
+}
+
+// tableCache bounds how many table files are open at once. Files are opened on first use,
+// kept in LRU order, and closed when pushed out. A handle in use when it is pushed out stays
+// open until its last reader releases it, so the bound can be exceeded briefly, never by
+// more than the reads in flight.
+//
+// With mmap set, every file is also mapped when it is opened. The mapping goes away with the
+// handle, so it is only unmapped once no read is using it.
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	mmap     bool
+	lru      *list.List // of *tableHandle, most recently used first
+	handles  map[uint64]*tableHandle
+
+	hits, misses atomic.Int64
+}
+
+func newTableCache(capacity int, mmap bool) *tableCache {
+	return &tableCache{capacity: capacity, mmap: mmap, lru: list.New(), handles: make(map[uint64]*tableHandle)}
+}
+
+// acquire returns an open handle on table num; release it when done.
+func (c *tableCache) acquire(num uint64, filename string) (*tableHandle, error) {
+	c.mu.Lock()
+	if h, ok := c.handles[num]; ok {
+		h.refs++
+		c.lru.MoveToFront(h.elem)
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return h, nil
+	}
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	// Open without the lock: a slow disk shouldn't hold up reads of tables that are open
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	h := &tableHandle{f: f, num: num, refs: 2}
+	if c.mmap {
+		if h.mapped, err = mmapFile(f); err != nil {
+			fmt.Printf("⚠️ Could not mmap %s, reading it with pread: %v\n", filename, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if theirs, ok := c.handles[num]; ok {
+		// Someone opened it meanwhile: use theirs
+		h.close()
+		theirs.refs++
+		c.lru.MoveToFront(theirs.elem)
+		return theirs, nil
+	}
+	h.elem = c.lru.PushFront(h)
+	c.handles[num] = h
+	for c.lru.Len() > c.capacity {
+		c.removeLocked(c.lru.Back().Value.(*tableHandle))
+	}
+	return h, nil
+}
+
+func (c *tableCache) release(h *tableHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unrefLocked(h)
+}
+
+// evict drops table num from the cache, once it is retired or the repository closes.
+func (c *tableCache) evict(num uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.handles[num]; ok {
+		c.removeLocked(h)
+	}
+}
+
+func (c *tableCache) removeLocked(h *tableHandle) {
+	c.lru.Remove(h.elem)
+	delete(c.handles, h.num)
+	h.evicted = true
+	c.unrefLocked(h) // the cache's reference
+}
+
+func (c *tableCache) unrefLocked(h *tableHandle) {
+	if h.refs--; h.refs == 0 && h.evicted {
+		h.close()
+	}
+}
+
+func (h *tableHandle) close() {
+	if h.mapped != nil {
+		munmap(h.mapped)
+		h.mapped = nil
+	}
+	h.f.Close()
+}
+
+// openFiles counts the files in the cache and how many of them are mapped.
+func (c *tableCache) openFiles() (open, mapped int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if e.Value.(*tableHandle).mapped != nil {
+			mapped++
+		}
+	}
+	return c.lru.Len(), mapped
+}
+
+// close drops every handle. Reads still in flight finish on their handle, then it is closed.
+func (c *tableCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back().Value.(*tableHandle))
+	}
+}
+
+// CacheStats counts the hits and misses of the block and table caches since open.
+type CacheStats struct {
+	BlockHits   int64
+	BlockMisses int64
+	BlockBytes  int64 // bytes of blocks held now
+	TableHits   int64 // reads that found the table file already open
+	TableMisses int64 // reads that had to open it
+	OpenFiles   int   // table files open now
+	MappedFiles int   // of which memory-mapped (see Options.MmapReads)
+}
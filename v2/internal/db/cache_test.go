@@ -0,0 +1,191 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A hot key is served from the block cache: the second Get reads nothing from disk.
+func TestBlockCacheServesRepeatedReads(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for i := 0; i < 1000; i++ {
+		repo.put(fmt.Sprintf("key%05d", i), []byte(fmt.Sprintf("value %d", i)))
+	}
+	repo.Flush()
+
+	if v, found, err := repo.Get("key00500"); err != nil || !found || string(v) != "value 500" {
+		t.Fatalf("Get = %q, %v, %v", v, found, err)
+	}
+	before := repo.CacheStats()
+	if before.BlockMisses == 0 || before.BlockBytes == 0 {
+		t.Fatalf("first read didn't go through the block cache: %+v", before)
+	}
+	for i := 0; i < 10; i++ {
+		if v, _, err := repo.Get("key00500"); err != nil || string(v) != "value 500" {
+			t.Fatalf("Get = %q, %v", v, err)
+		}
+	}
+	after := repo.CacheStats()
+	if after.BlockHits != before.BlockHits+10 || after.BlockMisses != before.BlockMisses {
+		t.Fatalf("stats went from %+v to %+v, want 10 hits and no misses", before, after)
+	}
+	if after.TableHits != before.TableHits || after.TableMisses != before.TableMisses {
+		t.Fatalf("cached reads touched the file: %+v then %+v", before, after)
+	}
+}
+
+func TestBlockCacheStaysWithinBudget(t *testing.T) {
+	c := newBlockCache(10 << 10)
+	data := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		c.add(blockKey{table: 1, offset: uint64(i) * 1000}, &block{data: data})
+		if c.size() > 10<<10 {
+			t.Fatalf("holding %d bytes after %d blocks", c.size(), i+1)
+		}
+	}
+	// The most recent blocks are the ones kept
+	if _, ok := c.get(blockKey{table: 1, offset: 49000}); !ok {
+		t.Fatal("newest block was evicted")
+	}
+	if _, ok := c.get(blockKey{table: 1, offset: 0}); ok {
+		t.Fatal("oldest block is still cached")
+	}
+	// A block bigger than the whole cache isn't cached at all
+	c.add(blockKey{table: 2}, &block{data: make([]byte, 20<<10)})
+	if _, ok := c.get(blockKey{table: 2}); ok || c.size() > 10<<10 {
+		t.Fatalf("oversized block cached, %d bytes held", c.size())
+	}
+}
+
+// More tables than MaxOpenFiles: every one stays readable, and no more files than that stay open.
+func TestTableCacheBoundsOpenFiles(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{MaxOpenFiles: 2, BlockCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for table := 0; table < 5; table++ {
+		repo.put(fmt.Sprintf("key%d", table), []byte(fmt.Sprintf("table %d", table)))
+		repo.Flush()
+	}
+	if len(repo.sstables) != 5 {
+		t.Fatalf("%d tables, want 5", len(repo.sstables))
+	}
+	for round := 0; round < 3; round++ {
+		for table := 0; table < 5; table++ {
+			v, found, err := repo.Get(fmt.Sprintf("key%d", table))
+			if err != nil || !found || string(v) != fmt.Sprintf("table %d", table) {
+				t.Fatalf("key%d = %q, %v, %v", table, v, found, err)
+			}
+			if open := repo.CacheStats().OpenFiles; open > 2 {
+				t.Fatalf("%d files open", open)
+			}
+		}
+	}
+	if stats := repo.CacheStats(); stats.TableMisses == 0 || stats.BlockHits != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// A handle pushed out of the cache while a read holds it stays usable until released.
+func TestTableCacheKeepsHandlesInUse(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		if err := os.WriteFile(name, []byte(fmt.Sprint(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	c := newTableCache(1, false)
+	held, err := c.acquire(0, names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 3; i++ {
+		h, err := c.acquire(uint64(i), names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.release(h)
+	}
+	if open, _ := c.openFiles(); open != 1 {
+		t.Fatalf("%d handles cached", open)
+	}
+	buf := make([]byte, 1)
+	if _, err := held.f.ReadAt(buf, 0); err != nil || buf[0] != '0' {
+		t.Fatalf("evicted handle in use: read %q, %v", buf, err)
+	}
+	c.release(held)
+	if _, err := held.f.ReadAt(buf, 0); err == nil {
+		t.Fatal("evicted handle still open after its last release")
+	}
+	c.close()
+	if open, _ := c.openFiles(); open != 0 {
+		t.Fatalf("%d handles left after close", open)
+	}
+}
+
+// Reads from mapped tables, including tables a compaction retires while an iterator still
+// reads them: they stay mapped until the iterator is closed, then go away with their files.
+func TestMmapReads(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepositoryWithOptions(dir, Options{MmapReads: true, Compression: CompressionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for table := 0; table < 4; table++ {
+		for i := table; i < 400; i += 4 {
+			repo.put(fmt.Sprintf("key%05d", i), []byte(fmt.Sprintf("value %d", i)))
+		}
+		repo.Flush()
+	}
+	for i := 0; i < 400; i++ {
+		if v, found, err := repo.Get(fmt.Sprintf("key%05d", i)); err != nil || !found || string(v) != fmt.Sprintf("value %d", i) {
+			t.Fatalf("key%05d = %q, %v, %v", i, v, found, err)
+		}
+	}
+	if stats := repo.CacheStats(); stats.MappedFiles != 4 {
+		t.Skipf("tables not mapped on this platform: %+v", stats)
+	}
+
+	it, err := repo.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("")
+	retired := []string{}
+	for _, sst := range repo.sstables {
+		retired = append(retired, sst.Filename)
+	}
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for ; it.Valid(); it.Next() {
+		if want := fmt.Sprintf("value %d", n); string(it.Value()) != want {
+			t.Fatalf("%s = %q, want %q", it.Key(), it.Value(), want)
+		}
+		n++
+	}
+	if it.Err() != nil || n != 400 {
+		t.Fatalf("iterated %d of 400: %v", n, it.Err())
+	}
+	it.Close()
+	for _, name := range retired {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("retired table %s still on disk: %v", name, err)
+		}
+	}
+	if v, _, err := repo.Get("key00123"); err != nil || string(v) != "value 123" {
+		t.Fatalf("after compaction: %q, %v", v, err)
+	}
+}
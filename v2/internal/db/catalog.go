@@ -0,0 +1,306 @@
+package db
+
+import (
+	"chill-db/internal/domain"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// kvStore is the raw key-value view the catalog is built on.
+type kvStore interface {
+	Get(key string) ([]byte, bool, error)
+	Scan(prefix string) (Iterator, error)
+	Write(batch *WriteBatch) error
+}
+
+// catalog implements the Repository methods (databases, tables, rows) on top of a kvStore:
+// the LSM tree itself, or a transaction that buffers its writes (see Txn).
+type catalog struct {
+	kv kvStore
+	// Creating and dropping take it exclusively. Row writes share it: their table check and
+	// their write must not have a DropDatabase in between, or the row outlives its table.
+	mu sync.RWMutex
+}
+
+func (c *catalog) set(key string, value []byte) error {
+	b := NewWriteBatch()
+	b.Put(key, value)
+	return c.kv.Write(b)
+}
+
+func (c *catalog) remove(key string) error {
+	b := NewWriteBatch()
+	b.Delete(key)
+	return c.kv.Write(b)
+}
+
+// scanKeys collects every live key starting with prefix, checking ctx as it goes.
+func (c *catalog) scanKeys(ctx context.Context, prefix string) ([]string, error) {
+	it, err := c.kv.Scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys = append(keys, it.Key())
+	}
+	return keys, it.Err()
+}
+
+// deletePrefix adds a tombstone to b for every live key under prefix.
+func (c *catalog) deletePrefix(ctx context.Context, b *WriteBatch, prefix string) error {
+	keys, err := c.scanKeys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		b.Delete(k)
+	}
+	return nil
+}
+
+// Key layout: databases and tables share one key space, namespaced by a type prefix.
+//
+//	d:<db>                -> database catalog entry
+//	t:<db>:<table>        -> JSON-encoded domain.TableMetaData
+//	r:<db>:<table>:<pk>   -> JSON-encoded domain.Row (pk is the first column)
+const (
+	dbKeyPrefix    = "d:"
+	tableKeyPrefix = "t:"
+	rowKeyPrefix   = "r:"
+)
+
+func dbKey(dbName string) string { return dbKeyPrefix + dbName }
+
+func tableKey(dbName, tableName string) string {
+	return tableKeyPrefix + dbName + ":" + tableName
+}
+
+func rowKey(dbName, tableName, pk string) string {
+	return rowPrefix(dbName, tableName) + pk
+}
+
+func rowPrefix(dbName, tableName string) string {
+	return rowKeyPrefix + dbName + ":" + tableName + ":"
+}
+
+// validName rejects names that would break the key layout above.
+func validName(kind, name string) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("invalid %s name '%s'", kind, name)
+	}
+	return nil
+}
+
+func (c *catalog) ListDatabases(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	keys, err := c.scanKeys(ctx, dbKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	dbs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		dbs = append(dbs, strings.TrimPrefix(k, dbKeyPrefix))
+	}
+	return dbs, nil
+}
+
+func (c *catalog) CreateDatabase(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validName("database", name); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists, err := c.kv.Get(dbKey(name)); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("database '%s' already exists", name)
+	}
+	return c.set(dbKey(name), []byte(name))
+}
+
+func (c *catalog) DropDatabase(ctx context.Context, dbName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validName("database", dbName); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Rows, tables and the catalog entry go in one batch: a crash can't leave half a database behind
+	if _, exists, err := c.kv.Get(dbKey(dbName)); err != nil || !exists {
+		return err
+	}
+	b := NewWriteBatch()
+	if err := c.deletePrefix(ctx, b, rowKeyPrefix+dbName+":"); err != nil {
+		return err
+	}
+	if err := c.deletePrefix(ctx, b, tableKeyPrefix+dbName+":"); err != nil {
+		return err
+	}
+	b.Delete(dbKey(dbName))
+	return c.kv.Write(b)
+}
+
+func (c *catalog) CreateTable(ctx context.Context, dbName string, table domain.TableMetaData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validName("table", table.Name); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists, err := c.kv.Get(dbKey(dbName)); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("database '%s' does not exist", dbName)
+	}
+	if _, exists, err := c.kv.Get(tableKey(dbName, table.Name)); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("table '%s' already exists in '%s'", table.Name, dbName)
+	}
+
+	meta, err := json.Marshal(table)
+	if err != nil {
+		return err
+	}
+	return c.set(tableKey(dbName, table.Name), meta)
+}
+
+// GetTable returns the schema stored for dbName.tableName.
+func (c *catalog) GetTable(ctx context.Context, dbName, tableName string) (domain.TableMetaData, error) {
+	var meta domain.TableMetaData
+	if err := ctx.Err(); err != nil {
+		return meta, err
+	}
+	val, exists, err := c.kv.Get(tableKey(dbName, tableName))
+	if err != nil {
+		return meta, err
+	}
+	if !exists {
+		return meta, fmt.Errorf("table '%s' does not exist", tableName)
+	}
+	if err := json.Unmarshal(val, &meta); err != nil {
+		return meta, fmt.Errorf("corrupt metadata for table '%s': %w", tableName, err)
+	}
+	return meta, nil
+}
+
+func (c *catalog) InsertRow(ctx context.Context, dbName, tableName string, row domain.Row) error {
+	if len(row) == 0 {
+		return fmt.Errorf("cannot insert an empty row")
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if _, err := c.GetTable(ctx, dbName, tableName); err != nil {
+		return err
+	}
+
+	jsonRow, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	// Using the first value as the primary key for the key generation
+	return c.set(rowKey(dbName, tableName, row[0]), jsonRow)
+}
+
+// InsertRows writes every row in one WriteBatch: after a crash either all of them are there or none.
+func (c *catalog) InsertRows(ctx context.Context, dbName, tableName string, rows []domain.Row) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if _, err := c.GetTable(ctx, dbName, tableName); err != nil {
+		return err
+	}
+
+	b := NewWriteBatch()
+	for _, row := range rows {
+		if len(row) == 0 {
+			return fmt.Errorf("cannot insert an empty row")
+		}
+		jsonRow, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		b.Put(rowKey(dbName, tableName, row[0]), jsonRow)
+	}
+	return c.kv.Write(b)
+}
+
+// GetRow is a point lookup by primary key (the first column).
+func (c *catalog) GetRow(ctx context.Context, dbName, tableName, pk string) (domain.Row, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	val, found, err := c.kv.Get(rowKey(dbName, tableName, pk))
+	if err != nil || !found {
+		return nil, false, err
+	}
+	var row domain.Row
+	if err := json.Unmarshal(val, &row); err != nil {
+		return nil, false, err
+	}
+	return row, true, nil
+}
+
+// DeleteRow removes the row with the given primary key. Deleting a missing row is not an error.
+func (c *catalog) DeleteRow(ctx context.Context, dbName, tableName, pk string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if _, err := c.GetTable(ctx, dbName, tableName); err != nil {
+		return err
+	}
+	return c.remove(rowKey(dbName, tableName, pk))
+}
+
+// Query returns every row of the table, ordered by primary key.
+func (c *catalog) Query(ctx context.Context, dbName, tableName string) ([]domain.Row, error) {
+	if _, err := c.GetTable(ctx, dbName, tableName); err != nil {
+		return nil, err
+	}
+
+	it, err := c.kv.Scan(rowPrefix(dbName, tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	rows := []domain.Row{}
+	for ; it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var row domain.Row
+		if err := json.Unmarshal(it.Value(), &row); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, it.Err()
+}
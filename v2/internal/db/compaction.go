@@ -1,110 +1,355 @@
 package db
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"sync"
+	"math"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// Compaction is one unit of work chosen by a CompactionStrategy: Inputs are merged into new
+// tables at OutputLevel, which replace them.
+//
+// The inputs must be a contiguous slice of history for their key range: no table left out
+// may hold versions of those keys that are older than some input's and newer than another's.
+// Level by level (level 0 newest first, every deeper level older than the one above) that means
+// a merge may never skip over a table in between.
+type Compaction struct {
+	Inputs      []*SSTable // in search order (newest first)
+	OutputLevel int
+	// Bottom: no table outside Inputs holds older versions of keys in their range, so
+	// tombstones no snapshot needs can go.
+	Bottom bool
+}
+
+// CompactionStrategy decides what the background worker compacts next. Pick is handed the
+// live tables in search order and returns nil when nothing needs doing. Calls are
+// serialized, so a strategy may keep state between them (don't share one between repositories).
+type CompactionStrategy interface {
+	Pick(tables []*SSTable, opts Options) *Compaction
+}
+
+// ParseCompactionStrategy reads a strategy name as given on a command line: "leveled" or "tiered".
+func ParseCompactionStrategy(s string) (CompactionStrategy, error) {
+	switch strings.TrimSpace(strings.ToLower(s)) {
+	case "leveled", "":
+		return &LeveledCompaction{}, nil
+	case "tiered", "size-tiered":
+		return &SizeTieredCompaction{}, nil
+	}
+	return nil, fmt.Errorf("invalid compaction strategy %q (want leveled or tiered)", s)
+}
+
+// errCompactionStopped aborts a compaction when the repository is closing.
+var errCompactionStopped = errors.New("compaction stopped: repository is closing")
+
+// StartCompactionWorker starts the background compaction goroutine (once; later calls do
+// nothing). It runs a pass (compactions until the strategy has nothing left to pick) when it
+// starts, after every flush, and every interval as a fallback.
+// Requests that arrive during a pass coalesce into a single next pass. Close stops it.
 func (r *LSMRepository) StartCompactionWorker(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	go func() {
-		for range ticker.C {
-			if err := r.Compact(); err != nil {
-				fmt.Println("Compaction error:", err)
-			}
+	r.workerOnce.Do(func() {
+		select {
+		case <-r.stopCompaction:
+			return // already closed
+		default:
 		}
+		r.workerRunning.Store(true)
+		// Look at the tree right away: it may have opened with work to do
+		r.compactPending.Store(true)
+		r.triggerCompaction()
+		go r.compactionWorker(interval)
+	})
+}
+
+func (r *LSMRepository) compactionWorker(interval time.Duration) {
+	defer close(r.workerDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer func() {
+		// Writers stalled on us must not wait forever
+		r.mu.Lock()
+		r.workerRunning.Store(false)
+		r.compacting.Store(false)
+		r.drained.Broadcast()
+		r.mu.Unlock()
 	}()
+
+	for {
+		select {
+		case <-r.stopCompaction:
+			return
+		case <-ticker.C:
+		case <-r.compactTrigger:
+		}
+		// compacting goes up before queued goes down: a writer never sees a gap between them
+		r.compacting.Store(true)
+		r.compactQueued.Store(false)
+		err := r.maybeCompact()
+
+		r.mu.Lock()
+		r.compacting.Store(false)
+		r.drained.Broadcast()
+		r.mu.Unlock()
+		if errors.Is(err, errCompactionStopped) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Compaction error:", err)
+		}
+	}
 }
 
-func (r *LSMRepository) Compact() error {
-	//Snapshot: Get list of files to compact
-	r.mu.RLock()
-	if len(r.sstables) <= 1 {
-		r.mu.RUnlock()
-		return nil // Nothing to do
-	}
-	// Copy the list so we can work without blocking queries
-	oldTables := make([]*SSTable, len(r.sstables))
-	copy(oldTables, r.sstables)
-	r.mu.RUnlock()
-
-	// results[0] will hold the map from oldFiles[0], etc.
-	results := make([]map[string][]byte, len(oldTables))
-	// Buffered channel to prevent goroutines from blocking if multiple errors occur
-	errChan := make(chan error, len(oldTables))
-
-	var wg sync.WaitGroup
-	for i, table := range oldTables {
-		wg.Add(1)
-		// We pass 'i' and 'filename' to capture them by value
-		go func(index int, sst *SSTable) {
-			defer wg.Done()
-			// Create a temporary SSTable struct
-			data, err := sst.Scan()
-			if err != nil {
-				errChan <- fmt.Errorf("failed to scan %s: %w", sst.Filename, err)
-				return
-			}
-			results[index] = data
-		}(i, table)
+// triggerCompaction asks the worker for a pass. It never blocks, and does nothing without a worker.
+func (r *LSMRepository) triggerCompaction() {
+	r.compactQueued.Store(true)
+	select {
+	case r.compactTrigger <- struct{}{}:
+	default: // a pass is already pending
 	}
+}
 
-	wg.Wait()
-	close(errChan)
-	if len(errChan) > 0 {
-		return <-errChan
+// stopping reports whether Close has been called.
+func (r *LSMRepository) stopping() bool {
+	select {
+	case <-r.stopCompaction:
+		return true
+	default:
+		return false
 	}
+}
 
-	// Iterate BACKWARDS (Oldest File -> Newest File)
-	// This ensures that if a key exists in both 'old' and 'new' files,
-	// the value from the 'new' file (processed later) overwrites the 'old' one.
-	mergedData := make(map[string][]byte)
-	for i := len(results) - 1; i >= 0; i-- {
-		fileData := results[i]
-		if fileData == nil {
-			continue
+// maybeCompact runs compactions until the strategy finds nothing left to do. What Pick
+// said last is kept in compactPending, for the write throttle.
+func (r *LSMRepository) maybeCompact() error {
+	r.compactMu.Lock()
+	defer r.compactMu.Unlock()
+
+	for {
+		if r.stopping() {
+			return errCompactionStopped
+		}
+		_, tables, _ := r.current()
+		c := r.opts.Compaction.Pick(tables, r.opts)
+		r.compactPending.Store(c != nil)
+		var err error
+		if c != nil {
+			err = r.runCompaction(c)
+		}
+		releaseTables(tables)
+		if c == nil || err != nil {
+			return err
 		}
-		// Loop through fileData and put every k,v into mergedData
-		for k, v := range fileData {
-			mergedData[k] = v
+	}
+}
+
+// Compact is a manual full compaction, whatever the strategy: every level is merged into
+// the next, down to the deepest level in use (at least level 1). Old versions and tombstones
+// no snapshot needs are dropped everywhere, at the price of rewriting most of the database.
+func (r *LSMRepository) Compact() error {
+	r.compactMu.Lock()
+	defer r.compactMu.Unlock()
+
+	_, tables, _ := r.current()
+	deepest := 1
+	for _, t := range tables {
+		deepest = max(deepest, t.Level)
+	}
+	releaseTables(tables)
+
+	for level := 0; level < deepest; level++ {
+		if r.stopping() {
+			return errCompactionStopped
+		}
+		_, tables, _ := r.current()
+		var c *Compaction
+		if inputs := tablesAt(tables, level); len(inputs) > 0 {
+			c = newLeveledCompaction(tables, level, inputs)
+		}
+		var err error
+		if c != nil {
+			err = r.runCompaction(c)
+		}
+		releaseTables(tables)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCompaction merges the inputs of c into new tables at c.OutputLevel and swaps them in.
+// The caller holds compactMu and a reference on every input.
+//
+// The merge streams: one sequential reader per input, a heap (mergingIterator) yielding every
+// version in key order, and output tables written as it goes, cut at TargetFileSize. Only
+// the versions of one key are in memory at a time, whatever the size of the inputs.
+func (r *LSMRepository) runCompaction(c *Compaction) error {
+	oldTables := c.Inputs
+
+	// Sources newest table first: on equal sequence numbers (adopted tables without them) the merge prefers the lower index
+	sources := make([]internalIterator, 0, len(oldTables))
+	for _, sst := range oldTables {
+		it, err := sst.newScanIterator()
+		if err != nil {
+			newMergingIterator(sources).Close()
+			return fmt.Errorf("failed to open %s: %w", sst.Filename, err)
 		}
+		sources = append(sources, it)
 	}
+	merged := newMergingIterator(sources)
+	defer merged.Close()
 
-	//  Write: Create the new compacted file
-	newFilename := fmt.Sprintf("%s/compacted_%d.db", r.storageDir, time.Now().UnixNano())
-	newSST, err := WriteSSTable(mergedData, newFilename)
-	if err != nil {
+	var outputs []*SSTable
+	var w *sstWriter // current output, nil between outputs
+	var wNum uint64
+	fail := func(err error) error {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			t.discard()
+		}
 		return err
 	}
+	finishOutput := func() error {
+		sst, err := w.finish()
+		w = nil
+		if err != nil {
+			return err
+		}
+		r.attach(sst, wNum)
+		if err := r.checkTable(sst); err != nil {
+			return err
+		}
+		outputs = append(outputs, sst)
+		return nil
+	}
 
-	//Swap: Update the active list atomically
-	r.mu.Lock()
+	smallestSnapshot := r.smallestSnapshot()
+	var versions []Entry
+	merged.SeekToFirst()
+	for merged.Valid() {
+		if r.stopping() {
+			return fail(errCompactionStopped)
+		}
+		key := merged.Key()
+		versions = versions[:0]
+		for ; merged.Valid() && merged.Key() == key; merged.Next() {
+			versions = append(versions, merged.Entry())
+		}
+		// A tombstone only has to stay while a deeper level may still hold a version it masks
+		kept := retainVersions(versions, smallestSnapshot, c.Bottom)
+		if len(kept) == 0 {
+			continue
+		}
+
+		// Cut between keys only: all versions of a key live in one table. An output to level 0
+		// is cut too (the writer holds the index and a hash per key of the table in memory),
+		// and its tables are kept together as one sorted run.
+		if w != nil && w.size() >= r.opts.TargetFileSize {
+			if err := finishOutput(); err != nil {
+				return fail(err)
+			}
+		}
+		if w == nil {
+			var filename string
+			wNum, filename = r.newTableFile()
+			var err error
+			if w, err = newSSTWriter(filename, r.tableOptions()); err != nil {
+				return fail(err)
+			}
+		}
+		for _, v := range kept {
+			if err := w.add(key, v); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := merged.Err(); err != nil {
+		return fail(fmt.Errorf("compaction read failed: %w", err))
+	}
+	if w != nil {
+		if err := finishOutput(); err != nil {
+			return fail(err)
+		}
+	}
 
-	// Calculate how many NEW files arrived during the compaction
+	edit := versionEdit{NextFile: r.nextFile.Load()}
+	for _, t := range oldTables {
+		edit.Deleted = append(edit.Deleted, filepath.Base(t.Filename))
+	}
+	for _, t := range outputs {
+		t.Level = c.OutputLevel
+		if c.OutputLevel == 0 && len(outputs) > 1 {
+			t.run = outputs[0].num
+		}
+		edit.Added = append(edit.Added, t.info())
+	}
 
-	newFilesCount := len(r.sstables) - len(oldTables)
-	// Build the new list
-	newSSTablesList := make([]*SSTable, 0)
-	if newFilesCount > 0 {
-		// Keep the new files!
-		newSSTablesList = append(newSSTablesList, r.sstables[:newFilesCount]...)
+	if r.beforeInstall != nil {
+		r.beforeInstall()
 	}
-	// Append our new compacted file
-	newSSTablesList = append(newSSTablesList, newSST)
-	// Update the pointer
-	r.sstables = newSSTablesList
 
-	r.mu.Unlock()
+	// Commit point: once the edit is in the MANIFEST the old tables are gone for good,
+	// even if we crash before deleting them (the next open cleans them up). The outputs'
+	// directory entries have to be durable by then.
+	if err := syncDir(r.storageDir); err != nil {
+		return fail(err)
+	}
+	if err := r.manifest.logEdit(edit); err != nil {
+		return fail(err)
+	}
 
-	//Cleanup: Delete old files (Delayed for safety)
-	go func() {
-		time.Sleep(5 * time.Second)
-		for _, t := range oldTables {
-			os.Remove(t.Filename)
+	//Swap: Update the active list atomically
+	r.mu.Lock()
+	retired := make(map[*SSTable]bool, len(oldTables))
+	for _, t := range oldTables {
+		retired[t] = true
+	}
+	// Tables flushed while we were merging are newer than all of our inputs: keep them
+	live := make([]*SSTable, 0, len(r.sstables)-len(oldTables)+len(outputs))
+	for _, t := range r.sstables {
+		if !retired[t] {
+			live = append(live, t)
 		}
-	}()
+	}
+	for _, t := range outputs {
+		t.ref()
+		live = append(live, t)
+	}
+	sortTables(live)
+	r.sstables = live
+	r.tablesChanged()
+	r.mu.Unlock()
 
+	//Cleanup: drop the tree's reference. Each old file is deleted as soon as the last
+	// Get or iterator still reading it lets go (at the latest when the caller releases its own).
+	for _, t := range oldTables {
+		t.unref()
+	}
 	return nil
 }
+
+// retainVersions drops the versions of one key (newest first) that no reader can see anymore.
+// Every live snapshot has a sequence number >= smallestSnapshot, and so does every future read:
+//   - a version is hidden for good once a newer version of the key is visible at smallestSnapshot;
+//   - a tombstone visible at smallestSnapshot masks nothing if no older table is left (bottom),
+//     so it goes too.
+//
+// Everything else is kept, because some snapshot may still be reading at that point in time.
+func retainVersions(versions []Entry, smallestSnapshot uint64, bottom bool) []Entry {
+	kept := versions[:0]
+	newerSeq := uint64(math.MaxUint64) // sequence number of the previous (newer) version
+	for _, v := range versions {
+		hidden := newerSeq <= smallestSnapshot
+		newerSeq = v.Seq
+		if hidden || (bottom && v.Tombstone && v.Seq <= smallestSnapshot) {
+			continue
+		}
+		kept = append(kept, v)
+	}
+	return kept
+}
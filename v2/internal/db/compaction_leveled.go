@@ -0,0 +1,120 @@
+package db
+
+// Leveled compaction. Flushes add tables to level 0, where key ranges overlap. Every deeper
+// level is one sorted run: its tables have disjoint key ranges, and level N+1 only holds
+// versions older than what level N holds for the same key. A compaction merges a few tables
+// of level N with the tables of level N+1 that overlap them and writes the result to level
+// N+1, so each run rewrites a slice of the key space instead of the whole database:
+//   - level 0 is compacted once it holds L0CompactionTrigger tables;
+//   - a deeper level once it outgrows its target size (Options.LevelSizes), one table at a
+//     time, taking turns through the key space.
+
+// tablesAt returns the tables of one level, in search order.
+func tablesAt(tables []*SSTable, level int) []*SSTable {
+	var out []*SSTable
+	for _, t := range tables {
+		if t.Level == level {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// LeveledCompaction is the default strategy (see the top of this file). It is tuned by
+// Options.L0CompactionTrigger and Options.LevelSizes.
+type LeveledCompaction struct {
+	pointer map[int]string // per level: largest key of the last table compacted out of it
+}
+
+// Pick returns the most urgent compaction, or nil if every level is in shape.
+// Each level gets a score (level 0: sorted runs / trigger, deeper: bytes / target) and the
+// highest one at or above 1 wins.
+func (l *LeveledCompaction) Pick(tables []*SSTable, opts Options) *Compaction {
+	best := 0
+	bestScore := float64(level0Runs(tables)) / float64(opts.L0CompactionTrigger)
+	// The last level is never compacted: there is nothing below it
+	for level := 1; level < opts.numLevels()-1; level++ {
+		var size int64
+		for _, t := range tablesAt(tables, level) {
+			size += t.Size
+		}
+		if score := float64(size) / float64(opts.levelTarget(level)); score > bestScore {
+			best, bestScore = level, score
+		}
+	}
+	if bestScore < 1 {
+		return nil
+	}
+
+	level := tablesAt(tables, best)
+	if best == 0 {
+		// Start from the oldest table, then pull in every level-0 table overlapping the range
+		// so far: a newer version of a key must never end up below an older one.
+		inputs := []*SSTable{level[len(level)-1]}
+		return newLeveledCompaction(tables, 0, expandLevel0(level, inputs))
+	}
+
+	// Round-robin through the key space: the first table after where this level's last compaction ended
+	if l.pointer == nil {
+		l.pointer = make(map[int]string)
+	}
+	pick := level[0]
+	for _, t := range level {
+		if t.SmallestKey > l.pointer[best] {
+			pick = t
+			break
+		}
+	}
+	l.pointer[best] = pick.LargestKey
+	return newLeveledCompaction(tables, best, []*SSTable{pick})
+}
+
+// expandLevel0 grows inputs until no other level-0 table overlaps their combined key range.
+func expandLevel0(level0, inputs []*SSTable) []*SSTable {
+	smallest, largest := keyRange(inputs)
+	picked := make(map[*SSTable]bool)
+	for _, t := range inputs {
+		picked[t] = true
+	}
+	for grown := true; grown; {
+		grown = false
+		for _, t := range level0 {
+			if !picked[t] && t.overlaps(smallest, largest) {
+				picked[t], grown = true, true
+				smallest, largest = min(smallest, t.SmallestKey), max(largest, t.LargestKey)
+			}
+		}
+	}
+	// Keep search order (newest first), the merge breaks ties between legacy tables with it
+	var out []*SSTable
+	for _, t := range level0 {
+		if picked[t] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func keyRange(tables []*SSTable) (smallest, largest string) {
+	smallest, largest = tables[0].SmallestKey, tables[0].LargestKey
+	for _, t := range tables[1:] {
+		smallest, largest = min(smallest, t.SmallestKey), max(largest, t.LargestKey)
+	}
+	return smallest, largest
+}
+
+// newLeveledCompaction merges inputs (from level) with the overlapping tables of the next
+// level, and works out whether the output is the bottom of the tree for its key range.
+func newLeveledCompaction(tables []*SSTable, level int, inputs []*SSTable) *Compaction {
+	c := &Compaction{Inputs: inputs, OutputLevel: level + 1, Bottom: true}
+	smallest, largest := keyRange(inputs)
+	for _, t := range tables {
+		switch {
+		case t.Level == level+1 && t.overlaps(smallest, largest):
+			c.Inputs = append(c.Inputs, t)
+		case t.Level > level+1 && t.overlaps(smallest, largest):
+			c.Bottom = false
+		}
+	}
+	return c
+}
@@ -0,0 +1,420 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkLevels verifies the shape of the tree: level 0 under its trigger and every deeper
+// level a sorted run of tables with disjoint key ranges.
+func checkLevels(t *testing.T, repo *LSMRepository) {
+	t.Helper()
+	if n := len(tablesAt(repo.sstables, 0)); n >= repo.opts.L0CompactionTrigger {
+		t.Fatalf("%d tables left in level 0", n)
+	}
+	for level := 1; level < repo.opts.numLevels(); level++ {
+		tables := tablesAt(repo.sstables, level)
+		for i := 1; i < len(tables); i++ {
+			if tables[i-1].LargestKey >= tables[i].SmallestKey {
+				t.Fatalf("level %d: %s [%s, %s] overlaps %s [%s, %s]", level,
+					tables[i-1].Filename, tables[i-1].SmallestKey, tables[i-1].LargestKey,
+					tables[i].Filename, tables[i].SmallestKey, tables[i].LargestKey)
+			}
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	// Uncompressed, so the tiny level targets are reached at the sizes this test writes
+	opts := Options{L0CompactionTrigger: 2, LevelSizes: []int64{2 << 10, 8 << 10, 1 << 30}, Compression: CompressionNone}
+	repo, err := NewLSMRepositoryWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite random slices of the key space, one flush each, so tables overlap in all sorts of ways
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+	for round := 0; round < 30; round++ {
+		start := rng.Intn(200)
+		for i := start; i < start+20; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			want[key] = fmt.Sprintf("v%d", round)
+			repo.put(key, []byte(want[key]))
+		}
+		repo.Flush()
+		if err := repo.maybeCompact(); err != nil {
+			t.Fatal(err)
+		}
+		checkLevels(t, repo)
+	}
+	if len(tablesAt(repo.sstables, 2)) == 0 {
+		t.Fatal("nothing reached level 2")
+	}
+
+	check := func() {
+		t.Helper()
+		for key, v := range want {
+			if got, _, err := repo.Get(key); err != nil || string(got) != v {
+				t.Fatalf("Get(%s) = %q, %v; want %q", key, got, err, v)
+			}
+		}
+	}
+	check()
+	repo.Close()
+
+	// Levels and key ranges come back from the MANIFEST
+	if repo, err = NewLSMRepositoryWithOptions(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	checkLevels(t, repo)
+	check()
+}
+
+// Compacting level 0 only rewrites the level-1 tables it overlaps.
+func TestCompactionLeavesDisjointTablesAlone(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{L0CompactionTrigger: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	repo.put("a", []byte("1"))
+	repo.put("b", []byte("1"))
+	repo.Flush()
+	repo.maybeCompact()
+	repo.put("x", []byte("1"))
+	repo.Flush()
+	repo.maybeCompact()
+	if len(repo.sstables) != 2 {
+		t.Fatalf("want 2 disjoint level-1 tables, got %d", len(repo.sstables))
+	}
+	ab, x := repo.sstables[0], repo.sstables[1]
+
+	repo.put("x", []byte("2"))
+	repo.Flush()
+	if err := repo.maybeCompact(); err != nil {
+		t.Fatal(err)
+	}
+	if repo.sstables[0] != ab {
+		t.Fatal("a table outside the compacted key range was rewritten")
+	}
+	if len(repo.sstables) != 2 || repo.sstables[1] == x {
+		t.Fatal("overlapping table not merged")
+	}
+	if v, _, _ := repo.Get("x"); string(v) != "2" {
+		t.Fatalf("x = %q, want 2", v)
+	}
+}
+
+func TestCompactionSplitsOutput(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{TargetFileSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 300; i++ {
+			repo.put(fmt.Sprintf("key-%03d", i), []byte(fmt.Sprintf("value-%d", round)))
+		}
+		repo.Flush()
+	}
+	// A snapshot keeps every version of "key-150" alive: they must not be split across tables
+	snap := repo.NewSnapshot()
+	defer snap.Release()
+	for v := 0; v < 100; v++ {
+		repo.put("key-150", []byte(fmt.Sprintf("version-%d", v)))
+	}
+	repo.Flush()
+
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	level1 := tablesAt(repo.sstables, 1)
+	if len(level1) < 5 || len(level1) != len(repo.sstables) {
+		t.Fatalf("want several level-1 tables, got %d of %d", len(level1), len(repo.sstables))
+	}
+	checkLevels(t, repo)
+	for _, sst := range level1 {
+		// One key's versions may overshoot the target, nothing else should
+		if sst.Size > 4<<10 && !(sst.SmallestKey <= "key-150" && "key-150" <= sst.LargestKey) {
+			t.Fatalf("%s is %d bytes, target is 1 KiB", sst.Filename, sst.Size)
+		}
+	}
+
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		want := "value-2"
+		if i == 150 {
+			want = "version-99"
+		}
+		if v, _, _ := repo.Get(key); string(v) != want {
+			t.Fatalf("Get(%s) = %q, want %q", key, v, want)
+		}
+	}
+	if v, _, _ := snap.Get("key-150"); string(v) != "value-2" {
+		t.Fatalf("snapshot Get(key-150) = %q, want value-2", v)
+	}
+}
+
+func TestSizeTieredPick(t *testing.T) {
+	tables := func(sizes ...int64) []*SSTable {
+		var out []*SSTable
+		for i, size := range sizes {
+			// Newest first, as in search order
+			seq := uint64(len(sizes) - i)
+			out = append(out, &SSTable{Size: size, SmallestSeq: seq, LargestSeq: seq})
+		}
+		return out
+	}
+	strategy := &SizeTieredCompaction{MinRuns: 3}
+	cases := []struct {
+		name   string
+		sizes  []int64
+		inputs []int // indexes into sizes
+		bottom bool
+	}{
+		{"similar newest runs", []int64{10, 12, 11, 500}, []int{0, 1, 2}, false},
+		{"similar oldest runs", []int64{500, 10, 12, 11}, []int{1, 2, 3}, true},
+		{"cheapest window wins", []int64{100, 120, 110, 10, 12, 11}, []int{3, 4, 5}, true},
+		{"not adjacent", []int64{10, 500, 10, 10}, nil, false},
+		{"too few", []int64{10, 10}, nil, false},
+	}
+	for _, c := range cases {
+		in := tables(c.sizes...)
+		got := strategy.Pick(in, DefaultOptions())
+		if c.inputs == nil {
+			if got != nil {
+				t.Errorf("%s: picked %d tables, want none", c.name, len(got.Inputs))
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: picked nothing", c.name)
+			continue
+		}
+		var want []*SSTable
+		for _, i := range c.inputs {
+			want = append(want, in[i])
+		}
+		if !reflect.DeepEqual(got.Inputs, want) || got.Bottom != c.bottom || got.OutputLevel != 0 {
+			t.Errorf("%s: got %d inputs, bottom %v, level %d", c.name, len(got.Inputs), got.Bottom, got.OutputLevel)
+		}
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{Compaction: &SizeTieredCompaction{MinRuns: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	want := make(map[string]string)
+	for round := 0; round < 27; round++ {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key-%03d", (round*17+i)%300)
+			want[key] = fmt.Sprintf("v%d", round)
+			repo.put(key, []byte(want[key]))
+		}
+		repo.Flush()
+		if err := repo.maybeCompact(); err != nil {
+			t.Fatal(err)
+		}
+		for _, sst := range repo.sstables {
+			if sst.Level != 0 {
+				t.Fatalf("size-tiered output at level %d", sst.Level)
+			}
+		}
+	}
+	// 27 flushes with runs merged three at a time: a handful of tiers, not 27 tables
+	if len(repo.sstables) > 8 {
+		t.Fatalf("%d tables left, runs are not being merged", len(repo.sstables))
+	}
+	for key, v := range want {
+		if got, _, err := repo.Get(key); err != nil || string(got) != v {
+			t.Fatalf("Get(%s) = %q, %v; want %q", key, got, err, v)
+		}
+	}
+}
+
+// A size-tiered merge in level 0 is cut at TargetFileSize like any output, and its tables
+// stay one sorted run, across a reopen too.
+func TestSizeTieredSplitsRuns(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Compaction: &SizeTieredCompaction{MinRuns: 3}, TargetFileSize: 8 << 10, Compression: CompressionNone}
+	repo, err := NewLSMRepositoryWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("x", 100)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 300; i++ {
+			repo.put(fmt.Sprintf("key-%03d", i), []byte(fmt.Sprintf("v%d-%s", round, value)))
+		}
+		repo.Flush()
+	}
+	if err := repo.maybeCompact(); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		t.Helper()
+		if len(repo.sstables) < 3 {
+			t.Fatalf("merged into %d tables, want the output cut", len(repo.sstables))
+		}
+		run := repo.sstables[0].run
+		for _, sst := range repo.sstables {
+			if sst.Level != 0 || sst.run == 0 || sst.run != run {
+				t.Fatalf("%s: level %d, run %d; want all in level 0, run %d", sst.Filename, sst.Level, sst.run, run)
+			}
+			if sst.Size > 2*opts.TargetFileSize {
+				t.Fatalf("%s: %d bytes", sst.Filename, sst.Size)
+			}
+		}
+		if runs := sortedRuns(repo.sstables); len(runs) != 1 || repo.l0Runs.Load() != 1 {
+			t.Fatalf("%d runs (%d counted for the throttle), want 1", len(runs), repo.l0Runs.Load())
+		}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			if v, _, err := repo.Get(key); err != nil || !bytes.HasPrefix(v, []byte("v2-")) {
+				t.Fatalf("Get(%s) = %.5q, %v", key, v, err)
+			}
+		}
+	}
+	check()
+	repo.Close()
+
+	if repo, err = NewLSMRepositoryWithOptions(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	check()
+}
+
+// The worker compacts on flush triggers (not just its timer), and Close stops it.
+func TestCompactionWorkerTriggersAndStops(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{L0CompactionTrigger: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.StartCompactionWorker(time.Hour)
+	repo.StartCompactionWorker(time.Hour) // no second worker
+
+	for i := 0; i < 2; i++ {
+		repo.put(fmt.Sprintf("k%d", i), []byte("v"))
+		repo.Flush()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for repo.l0Runs.Load() >= 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("level 0 was never compacted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-repo.workerDone:
+	default:
+		t.Fatal("Close returned with the worker still running")
+	}
+}
+
+func TestWriteStallUntilCompaction(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{
+		L0CompactionTrigger: 2,
+		L0SlowdownTrigger:   3,
+		L0StopTrigger:       4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	repo.StartCompactionWorker(time.Hour)
+
+	// Hold the worker off while level 0 piles up
+	repo.compactMu.Lock()
+	for i := 0; i < 4; i++ {
+		repo.put(fmt.Sprintf("k%d", i), []byte("v"))
+		repo.Flush()
+	}
+
+	done := make(chan error)
+	go func() { done <- repo.put("late", []byte("v")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("write went through with 4 tables in level 0: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if repo.stalls.Load() != 1 {
+		t.Fatalf("stalls = %d, want 1", repo.stalls.Load())
+	}
+
+	repo.compactMu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still stalled after compaction")
+	}
+	if n := repo.l0Runs.Load(); n >= 4 {
+		t.Fatalf("%d tables in level 0 after compaction", n)
+	}
+}
+
+// Past the throttle triggers, but with nothing the strategy can merge: writes go through
+// at full speed instead of waiting for passes that do nothing.
+func TestNoThrottleWithoutCompactionWork(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{
+		Compaction:        &SizeTieredCompaction{},
+		L0SlowdownTrigger: 4,
+		L0StopTrigger:     8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	// 9 level-0 tables, each three times the size of the next newer one: no two runs alike
+	for table := 8; table >= 0; table-- {
+		rows := 1
+		for i := 0; i < table; i++ {
+			rows *= 3
+		}
+		for i := 0; i < rows; i++ {
+			repo.put(fmt.Sprintf("t%d-%05d", table, i), []byte("v"))
+		}
+		repo.Flush()
+	}
+	if n := repo.l0Runs.Load(); n != 9 {
+		t.Fatalf("%d tables in level 0, want 9", n)
+	}
+	repo.StartCompactionWorker(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for repo.compactPending.Load() || repo.compactQueued.Load() || repo.compacting.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("the worker never found out there is nothing to do")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := repo.put(fmt.Sprintf("late-%03d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if repo.slowdowns.Load() != 0 || repo.stalls.Load() != 0 || repo.l0Runs.Load() != 9 {
+		t.Fatalf("slowdowns = %d, stalls = %d, %d tables in level 0", repo.slowdowns.Load(), repo.stalls.Load(), repo.l0Runs.Load())
+	}
+}
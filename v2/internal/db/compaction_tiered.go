@@ -0,0 +1,118 @@
+package db
+
+// Size-tiered compaction trades read cost and space for fewer rewrites: instead of pushing
+// data down level by level, it waits until several sorted runs of about the same size exist
+// and merges them into one bigger run. A key is rewritten roughly once per tier (log of the
+// data size) rather than once per level per overlapping table.
+//
+// A sorted run is a level-0 table (or the tables of an earlier merge, see below), or a whole
+// deeper level (left over from leveled compaction, or from a manual Compact). Runs are
+// merged only if they are adjacent in age, so the output's versions never skip over a run
+// that holds versions in between. Merges of level-0 runs stay in level 0, as one run: cut at
+// TargetFileSize like any compaction output, into tables with disjoint key ranges that share
+// a run number (the first table's) in the MANIFEST. A lookup skips all but one of them by
+// key range.
+
+const (
+	DefaultTieredMinRuns   = 4
+	DefaultTieredMaxRuns   = 32
+	DefaultTieredSizeRatio = 2.0
+)
+
+// SizeTieredCompaction merges MinRuns..MaxRuns adjacent runs whose sizes are all within
+// SizeRatio of each other. Zero fields take the defaults.
+type SizeTieredCompaction struct {
+	MinRuns   int
+	MaxRuns   int
+	SizeRatio float64
+}
+
+// sortedRun is a set of tables forming one run, in search order.
+type sortedRun struct {
+	tables []*SSTable
+	level  int
+	run    uint64 // level 0: the tables' run number
+	size   int64
+}
+
+// sortedRuns lists the runs newest first: every level-0 run, then each deeper level. The
+// tables of a level-0 run are next to each other in search order: their sequence ranges all
+// lie within the run's, which no other run's overlaps.
+func sortedRuns(tables []*SSTable) []sortedRun {
+	var runs []sortedRun
+	for _, t := range tables {
+		if len(runs) == 0 || runs[len(runs)-1].level != t.Level ||
+			(t.Level == 0 && (t.run == 0 || runs[len(runs)-1].run != t.run)) {
+			runs = append(runs, sortedRun{level: t.Level, run: t.run})
+		}
+		run := &runs[len(runs)-1]
+		run.tables = append(run.tables, t)
+		run.size += t.Size
+	}
+	return runs
+}
+
+// level0Runs counts the sorted runs in level 0: what a lookup has to search there, at most
+// one table per run.
+func level0Runs(tables []*SSTable) int {
+	n := 0
+	for _, run := range sortedRuns(tables) {
+		if run.level == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Pick returns the window of similar-sized adjacent runs with the smallest total size (the
+// cheapest merge), or nil if no window is long enough.
+func (s *SizeTieredCompaction) Pick(tables []*SSTable, opts Options) *Compaction {
+	minRuns, maxRuns, ratio := s.MinRuns, s.MaxRuns, s.SizeRatio
+	if minRuns < 2 {
+		minRuns = DefaultTieredMinRuns
+	}
+	if maxRuns < minRuns {
+		maxRuns = max(DefaultTieredMaxRuns, minRuns)
+	}
+	if ratio <= 1 {
+		ratio = DefaultTieredSizeRatio
+	}
+
+	runs := sortedRuns(tables)
+	bestStart, bestEnd, bestSize := -1, -1, int64(0)
+	for start := range runs {
+		smallest, largest := runs[start].size, runs[start].size
+		total := runs[start].size
+		end := start + 1
+		for ; end < len(runs) && end-start < maxRuns; end++ {
+			lo, hi := min(smallest, runs[end].size), max(largest, runs[end].size)
+			if float64(hi) > float64(max(lo, 1))*ratio {
+				break
+			}
+			smallest, largest = lo, hi
+			total += runs[end].size
+		}
+		if end-start >= minRuns && (bestStart < 0 || total < bestSize) {
+			bestStart, bestEnd, bestSize = start, end, total
+		}
+	}
+	if bestStart < 0 {
+		return nil
+	}
+
+	// Tables adopted from before sequence numbers all have Seq 0 and are only ordered by file
+	// number, which a merge output would jump. They are the oldest runs: take all of them at once.
+	for _, t := range runs[bestStart:bestEnd] {
+		if t.tables[0].LargestSeq == 0 {
+			bestEnd = len(runs)
+			break
+		}
+	}
+
+	c := &Compaction{Bottom: bestEnd == len(runs)}
+	for _, run := range runs[bestStart:bestEnd] {
+		c.Inputs = append(c.Inputs, run.tables...)
+		c.OutputLevel = max(c.OutputLevel, run.level)
+	}
+	return c
+}
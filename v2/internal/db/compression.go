@@ -0,0 +1,173 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Compression picks the codec for SSTable data blocks. Each block records the codec it was
+// written with, so changing this only affects new tables: old ones stay readable.
+type Compression int
+
+const (
+	// CompressionSnappy is fast and typically halves JSON rows (the default).
+	CompressionSnappy Compression = iota
+	// CompressionNone stores blocks as they are.
+	CompressionNone
+	// CompressionFlate (DEFLATE at its fastest level) compresses better than Snappy at several times the CPU.
+	CompressionFlate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ParseCompression reads a codec name as given on a command line: "snappy", "none" or "flate".
+func ParseCompression(s string) (Compression, error) {
+	switch strings.TrimSpace(strings.ToLower(s)) {
+	case "snappy", "":
+		return CompressionSnappy, nil
+	case "none", "off":
+		return CompressionNone, nil
+	case "flate", "deflate":
+		return CompressionFlate, nil
+	}
+	return 0, fmt.Errorf("invalid compression %q (want snappy, none or flate)", s)
+}
+
+// Block types, stored in the first byte of the trailer after every block. Independent of
+// the Compression values, which are only an option and may be renumbered.
+const (
+	blockTypeRaw     byte = 0
+	blockTypeSnappy  byte = 1
+	blockTypeFlate   byte = 2
+	blockTrailerSize      = 5 // [type][crc32c u32]
+)
+
+// blockCompressor compresses the blocks of one table. It keeps its codec state between blocks.
+type blockCompressor struct {
+	c      Compression
+	out    []byte
+	snappy *snappyEncoder
+	fbuf   bytes.Buffer
+	fw     *flate.Writer
+}
+
+// compress returns what to store for raw and its block type. A block that doesn't shrink by
+// at least 1/8 is stored raw: not worth decompressing on every read.
+func (bc *blockCompressor) compress(raw []byte) ([]byte, byte) {
+	var typ byte
+	switch bc.c {
+	case CompressionSnappy:
+		if bc.snappy == nil {
+			bc.snappy = &snappyEncoder{}
+		}
+		bc.out = bc.snappy.encode(bc.out[:0], raw)
+		typ = blockTypeSnappy
+	case CompressionFlate:
+		// [uncompressed length uvarint][deflate stream], so the reader allocates once
+		bc.fbuf.Reset()
+		bc.fbuf.Write(binary.AppendUvarint(bc.out[:0], uint64(len(raw))))
+		if bc.fw == nil {
+			bc.fw, _ = flate.NewWriter(&bc.fbuf, flate.BestSpeed) // only fails on a bad level
+		} else {
+			bc.fw.Reset(&bc.fbuf)
+		}
+		bc.fw.Write(raw)
+		bc.fw.Close()
+		bc.out = append(bc.out[:0], bc.fbuf.Bytes()...)
+		typ = blockTypeFlate
+	default:
+		return raw, blockTypeRaw
+	}
+	if len(bc.out) > len(raw)-len(raw)/8 {
+		return raw, blockTypeRaw
+	}
+	return bc.out, typ
+}
+
+var flateReaders sync.Pool
+
+// decompressBlock undoes compress. A raw block is returned as is.
+func decompressBlock(typ byte, data []byte) ([]byte, error) {
+	switch typ {
+	case blockTypeRaw:
+		return data, nil
+	case blockTypeSnappy:
+		return snappyDecode(data)
+	case blockTypeFlate:
+		n, k := binary.Uvarint(data)
+		if k <= 0 || n > maxDecodedBlockLen {
+			return nil, fmt.Errorf("flate: corrupt length")
+		}
+		src := bytes.NewReader(data[k:])
+		r, _ := flateReaders.Get().(io.ReadCloser)
+		if r == nil {
+			r = flate.NewReader(src)
+		} else if err := r.(flate.Resetter).Reset(src, nil); err != nil {
+			return nil, err
+		}
+		defer flateReaders.Put(r)
+		out := make([]byte, n)
+		if _, err := io.ReadFull(r, out); err != nil {
+			return nil, fmt.Errorf("flate: %w", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown block type %d", typ)
+}
+
+// CompressionStats counts the data blocks written since the repository was opened.
+type CompressionStats struct {
+	Blocks           int64 // data blocks written
+	CompressedBlocks int64 // of which stored compressed (the rest didn't shrink enough)
+	RawBytes         int64 // their size before compression
+	StoredBytes      int64 // their size as stored in the files
+}
+
+// Ratio is stored/raw bytes: 0.4 means blocks take 40% of their uncompressed size.
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.StoredBytes) / float64(s.RawBytes)
+}
+
+type compressionStats struct {
+	blocks, compressed, raw, stored atomic.Int64
+}
+
+func (s *compressionStats) add(raw, stored int, typ byte) {
+	if s == nil {
+		return
+	}
+	s.blocks.Add(1)
+	if typ != blockTypeRaw {
+		s.compressed.Add(1)
+	}
+	s.raw.Add(int64(raw))
+	s.stored.Add(int64(stored))
+}
+
+func (s *compressionStats) snapshot() CompressionStats {
+	return CompressionStats{
+		Blocks:           s.blocks.Load(),
+		CompressedBlocks: s.compressed.Load(),
+		RawBytes:         s.raw.Load(),
+		StoredBytes:      s.stored.Load(),
+	}
+}
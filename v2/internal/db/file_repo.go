@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bytes"
 	"chill-db/internal/domain"
 	"context"
 	"encoding/csv"
@@ -38,7 +39,7 @@ func (r *FileRepository) resolvePath(segments ...string) (string, error) { // a
 
 func (r *FileRepository) ListDatabases(ctx context.Context) ([]string, error) {
 	r.mu.RLock()
-	defer r.mu.Unlock()
+	defer r.mu.RUnlock()
 
 	entries, err := os.ReadDir(r.DataDir)
 
@@ -166,6 +167,46 @@ func (r *FileRepository) InsertRow(ctx context.Context, dbName, tableName string
 	return nil
 }
 
+// InsertRows appends every row with a single buffered write, so they land in the file together.
+func (r *FileRepository) InsertRows(ctx context.Context, dbName, tableName string, rows []domain.Row) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dataPath, err := r.resolvePath(dbName, tableName+".data")
+	if err != nil {
+		return err
+	}
+
+	// Encode everything up front: a bad row fails the whole insert before we touch the file
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.WriteAll(toRecords(rows)); err != nil {
+		return fmt.Errorf("failed to write rows: %w", err)
+	}
+
+	file, err := os.OpenFile(dataPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("table '%s' does not exist", tableName)
+		}
+		return fmt.Errorf("failed to open table: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write rows: %w", err)
+	}
+	return nil
+}
+
+func toRecords(rows []domain.Row) [][]string {
+	records := make([][]string, len(rows))
+	for i, row := range rows {
+		records[i] = row
+	}
+	return records
+}
+
 func (r *FileRepository) Query(ctx context.Context, dbName, tableName string) ([]domain.Row, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -0,0 +1,290 @@
+package db
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// Iterator walks live keys of the LSM tree in ascending order.
+//
+//	it, _ := repo.Scan("r:shop:users:")
+//	defer it.Close()
+//	for ; it.Valid(); it.Next() { ... it.Key(), it.Value() ... }
+//	if err := it.Err(); err != nil { ... }
+type Iterator interface {
+	// Seek moves to the first key >= key (clamped to the iterator's bounds).
+	Seek(key string)
+	Next()
+	Valid() bool
+	Key() string
+	Value() []byte
+	// Err reports the first I/O error; Valid turns false when one happens.
+	Err() error
+	Close() error
+}
+
+// internalIterator is what the merge consumes: it surfaces every version of a key (newest
+// first) and tombstones too, because a tombstone in a newer source must hide the key in older ones.
+type internalIterator interface {
+	Seek(key string)
+	SeekToFirst()
+	Next()
+	Valid() bool
+	Key() string
+	Entry() Entry
+	Err() error
+	Close() error
+}
+
+func (it *skipListIterator) Err() error   { return nil }
+func (it *skipListIterator) Close() error { return nil }
+
+// mergingIterator is a k-way merge of sorted sources using a min-heap. It yields every
+// version of every key, ordered by key and then by sequence number, newest first; picking
+// the one a reader may see is lsmIterator's job. Sources are ordered newest first, which only
+// breaks ties for tables adopted from before sequence numbers existed (they all have Seq 0).
+type mergingIterator struct {
+	sources []internalIterator
+	heap    mergeHeap
+}
+
+func newMergingIterator(sources []internalIterator) *mergingIterator {
+	return &mergingIterator{sources: sources, heap: mergeHeap{sources: sources}}
+}
+
+// mergeHeap orders source indexes by (current key, version): smallest key first, then highest Seq, then newest source.
+type mergeHeap struct {
+	sources []internalIterator
+	order   []int
+}
+
+func (h mergeHeap) Len() int { return len(h.order) }
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[h.order[i]], h.sources[h.order[j]]
+	if a.Key() != b.Key() {
+		return a.Key() < b.Key()
+	}
+	if seqA, seqB := a.Entry().Seq, b.Entry().Seq; seqA != seqB {
+		return seqA > seqB
+	}
+	return h.order[i] < h.order[j] // lower index = newer source
+}
+func (h mergeHeap) Swap(i, j int) { h.order[i], h.order[j] = h.order[j], h.order[i] }
+func (h *mergeHeap) Push(x any)   { h.order = append(h.order, x.(int)) }
+func (h *mergeHeap) Pop() any {
+	last := h.order[len(h.order)-1]
+	h.order = h.order[:len(h.order)-1]
+	return last
+}
+
+func (m *mergingIterator) rebuild() {
+	m.heap.order = m.heap.order[:0]
+	for i, src := range m.sources {
+		if src.Valid() {
+			m.heap.order = append(m.heap.order, i)
+		}
+	}
+	heap.Init(&m.heap)
+}
+
+func (m *mergingIterator) Seek(key string) {
+	for _, src := range m.sources {
+		src.Seek(key)
+	}
+	m.rebuild()
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, src := range m.sources {
+		src.SeekToFirst()
+	}
+	m.rebuild()
+}
+
+func (m *mergingIterator) Valid() bool { return len(m.heap.order) > 0 }
+
+func (m *mergingIterator) top() internalIterator { return m.sources[m.heap.order[0]] }
+
+func (m *mergingIterator) Key() string { return m.top().Key() }
+
+func (m *mergingIterator) Entry() Entry { return m.top().Entry() }
+
+func (m *mergingIterator) Next() {
+	src := m.top()
+	src.Next()
+	if src.Valid() {
+		heap.Fix(&m.heap, 0)
+	} else {
+		heap.Pop(&m.heap)
+	}
+}
+
+func (m *mergingIterator) Err() error {
+	for _, src := range m.sources {
+		if err := src.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergingIterator) Close() error {
+	var errs []error
+	for _, src := range m.sources {
+		errs = append(errs, src.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// lsmIterator is the user-facing view of the merge as of sequence number seq: for every key
+// it shows the newest version with Seq <= seq, skips the key if that version is a tombstone,
+// and keys are restricted to [lower, upper). An empty upper means no upper bound.
+type lsmIterator struct {
+	merged    *mergingIterator
+	tables    []*SSTable // referenced until Close
+	seq       uint64
+	lower     string
+	upper     string
+	exhausted bool
+}
+
+func (it *lsmIterator) Seek(key string) {
+	if key < it.lower {
+		key = it.lower
+	}
+	it.exhausted = false
+	it.merged.Seek(key)
+	it.skipInvisible()
+}
+
+func (it *lsmIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.skipKey(it.merged.Key())
+	it.skipInvisible()
+}
+
+// skipKey moves past the remaining (older) versions of key.
+func (it *lsmIterator) skipKey(key string) {
+	for it.merged.Valid() && it.merged.Key() == key {
+		it.merged.Next()
+	}
+}
+
+// skipInvisible stops on the first version the iterator may show.
+func (it *lsmIterator) skipInvisible() {
+	for it.merged.Valid() {
+		if it.upper != "" && it.merged.Key() >= it.upper {
+			it.exhausted = true
+			return
+		}
+		entry := it.merged.Entry()
+		switch {
+		case entry.Seq > it.seq:
+			it.merged.Next() // written after our point in time, an older version may follow
+		case entry.Tombstone:
+			it.skipKey(it.merged.Key())
+		default:
+			return
+		}
+	}
+}
+
+func (it *lsmIterator) Valid() bool {
+	return !it.exhausted && it.merged.Valid() && it.merged.Err() == nil
+}
+func (it *lsmIterator) Key() string   { return it.merged.Key() }
+func (it *lsmIterator) Value() []byte { return it.merged.Entry().Value }
+func (it *lsmIterator) Err() error    { return it.merged.Err() }
+
+func (it *lsmIterator) Close() error {
+	err := it.merged.Close()
+	releaseTables(it.tables)
+	it.tables = nil
+	return err
+}
+
+// NewIterator returns an unpositioned iterator over the whole key space; call Seek first.
+// It sees the database as of its creation: writes made afterwards never show up, and the
+// MemTables and SSTables it reads stay readable even if they are flushed or compacted away
+// meanwhile. A compacted-away file is only deleted once the iterator is closed, so always Close it.
+func (r *LSMRepository) NewIterator() (Iterator, error) {
+	mems, activeFiles, seq := r.current()
+	return r.iteratorOver(mems, activeFiles, "", "", seq, nil)
+}
+
+// Range returns an iterator over keys in [start, end), positioned on the first one.
+// An empty end means "to the last key".
+func (r *LSMRepository) Range(start, end string) (Iterator, error) {
+	mems, activeFiles, seq := r.current()
+	it, err := r.iteratorOver(mems, activeFiles, start, end, seq, nil)
+	if err != nil {
+		return nil, err
+	}
+	it.Seek(start)
+	return it, nil
+}
+
+// Scan returns an iterator over every key starting with prefix, positioned on the first one.
+func (r *LSMRepository) Scan(prefix string) (Iterator, error) {
+	return r.Range(prefix, prefixEnd(prefix))
+}
+
+func (r *LSMRepository) rangeAt(start, end string, seq uint64) (Iterator, error) {
+	it, err := r.newIterator(start, end, seq)
+	if err != nil {
+		return nil, err
+	}
+	it.Seek(start)
+	return it, nil
+}
+
+// prefixEnd is the smallest key greater than every key starting with prefix ("" if there is none).
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// newIterator opens an iterator as of seq, which must be a snapshot's: the tables it holds
+// references on are never rewritten, but a compaction may already have installed outputs
+// without versions only visible at an unregistered seq (see current).
+// staged MemTables (a transaction's own writes) are merged in front of the tree: on a tie
+// in key and Seq they win.
+func (r *LSMRepository) newIterator(lower, upper string, seq uint64, staged ...*MemTable) (*lsmIterator, error) {
+	mems, activeFiles, _ := r.current()
+	return r.iteratorOver(mems, activeFiles, lower, upper, seq, staged)
+}
+
+// iteratorOver opens an iterator over a view taken by current, and takes over its references.
+func (r *LSMRepository) iteratorOver(mems []*MemTable, activeFiles []*SSTable, lower, upper string, seq uint64, staged []*MemTable) (*lsmIterator, error) {
+	var sources []internalIterator
+	for _, mem := range append(staged, mems...) {
+		sources = append(sources, mem.NewIterator())
+	}
+	// Tables whose key range misses the iterator's bounds are left out, and so are, for a range
+	// within one prefix, the tables whose filter rules the prefix out
+	prefix, usePrefix := scanPrefix(r.opts.PrefixExtractor, lower, upper)
+	for _, sst := range activeFiles {
+		if !sst.mayOverlapRange(lower, upper) {
+			continue
+		}
+		if usePrefix && !sst.mayContainPrefix(r.opts.PrefixExtractor, prefix) {
+			continue
+		}
+		it, err := sst.NewIterator()
+		if err != nil {
+			newMergingIterator(sources).Close()
+			releaseTables(activeFiles)
+			return nil, err
+		}
+		sources = append(sources, it)
+	}
+	return &lsmIterator{merged: newMergingIterator(sources), tables: activeFiles, seq: seq, lower: lower, upper: upper}, nil
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// drain reads every key=value pair left in it and closes it.
+func drain(it Iterator, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var out []string
+	for ; it.Valid(); it.Next() {
+		out = append(out, it.Key()+"="+string(it.Value()))
+	}
+	return out, it.Err()
+}
+
+func TestLSMIteratorMergesAllLevels(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	collect := func(it Iterator, err error) []string {
+		t.Helper()
+		out, err := drain(it, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// Oldest table
+	for i := 0; i < 300; i++ { // > 100 keys so Seek has to use the sparse index
+		repo.put(fmt.Sprintf("a:%03d", i), []byte("v1"))
+	}
+	repo.put("b:1", []byte("v1"))
+	repo.put("b:2", []byte("v1"))
+	repo.Flush()
+
+	// Newer table overwrites and deletes
+	repo.put("b:1", []byte("v2"))
+	repo.Delete("b:2")
+	repo.put("c:1", []byte("v2"))
+	repo.Flush()
+
+	// MemTable on top
+	repo.put("b:3", []byte("v3"))
+	repo.put("c:1", []byte("v3"))
+	repo.Delete("a:150")
+
+	got := collect(repo.Scan("b:"))
+	want := []string{"b:1=v2", "b:3=v3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Scan(b:) = %v, want %v", got, want)
+	}
+
+	got = collect(repo.Range("a:148", "a:153"))
+	want = []string{"a:148=v1", "a:149=v1", "a:151=v1", "a:152=v1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Range = %v, want %v", got, want)
+	}
+
+	got = collect(repo.Range("b:", ""))
+	want = []string{"b:1=v2", "b:3=v3", "c:1=v3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("open-ended Range = %v, want %v", got, want)
+	}
+
+	// Seek is clamped to the lower bound and respects the upper one
+	it, err := repo.Scan("b:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	it.Seek("a")
+	if !it.Valid() || it.Key() != "b:1" {
+		t.Fatalf("Seek below lower bound landed on %q", it.Key())
+	}
+	it.Seek("b:4")
+	if it.Valid() {
+		t.Fatalf("Seek past the prefix should be invalid, got %q", it.Key())
+	}
+
+	all := collect(repo.Scan(""))
+	if len(all) != 299+3 {
+		t.Fatalf("full scan returned %d keys, want %d", len(all), 302)
+	}
+}
+
+// Next past the end is a no-op, as for every other iterator.
+func TestLSMIteratorNextWhenExhausted(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	repo.put("a", []byte("1"))
+	repo.put("b", []byte("2"))
+
+	it, err := repo.Scan("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for i := 0; i < 3; i++ {
+		it.Next()
+	}
+	if it.Valid() || it.Err() != nil {
+		t.Fatalf("valid %v, err %v after running off the end", it.Valid(), it.Err())
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{"r:db:": "r:db;", "a\xff": "b", "\xff\xff": "", "": ""}
+	for in, want := range cases {
+		if got := prefixEnd(in); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// Versions are ordered by sequence number, not by where a source sits in the list.
+func TestMergingIteratorHighestSeqWins(t *testing.T) {
+	older, newer := NewMemTable(), NewMemTable()
+	put := func(m *MemTable, seq uint64, key, value string) {
+		b := NewWriteBatch()
+		b.Put(key, []byte(value))
+		b.seq = seq
+		m.apply(b)
+	}
+	put(older, 1, "k", "old")
+	put(older, 2, "only-old", "x")
+	put(newer, 7, "k", "new")
+
+	// Deliberately list the older source first
+	merged := newMergingIterator([]internalIterator{older.NewIterator(), newer.NewIterator()})
+	merged.SeekToFirst()
+	if merged.Key() != "k" || string(merged.Entry().Value) != "new" || merged.Entry().Seq != 7 {
+		t.Fatalf("got %s=%s@%d, want k=new@7", merged.Key(), merged.Entry().Value, merged.Entry().Seq)
+	}
+	merged.Next()
+	if merged.Key() != "k" || merged.Entry().Seq != 1 {
+		t.Fatalf("expected the older version of k next, got %s@%d", merged.Key(), merged.Entry().Seq)
+	}
+	merged.Next()
+	if merged.Key() != "only-old" {
+		t.Fatalf("got %s, want only-old", merged.Key())
+	}
+}
@@ -1,235 +1,828 @@
 package db
 
 import (
-	"chill-db/internal/domain"
+	"bufio"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type LSMRepository struct {
-	memTable   *MemTable
-	wal        *WAL
+	opts       Options
 	storageDir string
-	sstables   []*SSTable   // Cache of active SSTable filenames (sorted Newest -> Oldest)
-	mu         sync.RWMutex // Protects sstables slice
+
+	// mu protects the current shape of the tree: which MemTables, WAL segment and SSTables are live.
+	// Writers hold it shared for their WAL append + MemTable insert, so a rotation (exclusive)
+	// never swaps the MemTable out from under a half-done write.
+	mu       sync.RWMutex
+	memTable *MemTable  // Active MemTable, takes every write
+	imm      *MemTable  // Frozen MemTable being flushed in the background (nil if none)
+	wal      *WAL       // WAL segment backing memTable
+	logNum   uint64     // Number of the active WAL segment (wal_<logNum>.log)
+	sstables []*SSTable // Live SSTables in search order (see sortTables), each holding a reference
+	flushed  *sync.Cond // Broadcast on mu whenever imm is flushed (or the flush fails)
+	bgErr    error      // Sticky background flush error; every later write fails with it
+	recovery RecoveryReport
+
+	manifest  *manifest     // Edit log of the live SSTable set
+	nextFile  atomic.Uint64 // Number of the next SSTable file (sst_<num>.db)
+	lastSeq   atomic.Uint64 // Sequence number of the last write
+	compactMu sync.Mutex    // One compaction at a time
+
+	// Background compaction (see StartCompactionWorker) and the write throttle that keeps level 0 in check
+	compactTrigger chan struct{} // Capacity 1: requests made while one is pending coalesce into one pass
+	stopCompaction chan struct{} // Closed by Close: the worker exits, a running compaction gives up
+	workerDone     chan struct{} // Closed when the worker has exited
+	workerOnce     sync.Once
+	stopOnce       sync.Once
+	workerRunning  atomic.Bool
+	compactQueued  atomic.Bool  // A pass was requested and hasn't started yet
+	compacting     atomic.Bool  // A pass is running (cleared under mu)
+	compactPending atomic.Bool  // The strategy may have work: set when the tables change, then whatever its last Pick said
+	drained        *sync.Cond   // Broadcast on mu when the table set changes or a pass ends; stalled writers wait on it
+	l0Runs         atomic.Int32 // Sorted runs in level 0 (tables, unless size-tiered merged some), for the write throttle
+	slowdowns      atomic.Int64 // Writes delayed because level 0 was over L0SlowdownTrigger
+	stalls         atomic.Int64 // Writes that waited because level 0 was at L0StopTrigger
+	beforeInstall  func()       // Tests only: runs after a compaction's merge, before its outputs are installed
+
+	compression compressionStats // Data blocks written by flushes and compactions
+	blockCache  *blockCache      // Decoded data blocks of every table; nil if disabled
+	tableCache  *tableCache      // Open table files, at most MaxOpenFiles
+
+	visibleSeq atomic.Uint64  // Every write up to here is in a MemTable: what new reads see (see publish)
+	pubMu      sync.Mutex     // Orders publish calls
+	pubCond    *sync.Cond     // Broadcast on pubMu whenever visibleSeq moves
+	snapMu     sync.Mutex     // Protects snapshots
+	snapshots  map[uint64]int // Live snapshots, counted by sequence number
+	commitMu   sync.Mutex     // Serializes transaction commits (conflict check + write)
+
+	catalog // Databases, tables and rows, stored in the tree itself
 }
 
+// Compile-time check: the LSM engine is a drop-in replacement for FileRepository.
+var _ TxRepository = (*LSMRepository)(nil)
+
 func NewLSMRepository(storageDir string) (*LSMRepository, error) {
-	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
-		os.Mkdir(storageDir, 0755) // Use MkdirAll just in case
+	return NewLSMRepositoryWithOptions(storageDir, DefaultOptions())
+}
+
+func NewLSMRepositoryWithOptions(storageDir string, opts Options) (*LSMRepository, error) {
+	if err := os.MkdirAll(storageDir, 0755); err != nil {
+		return nil, err
 	}
 
 	repo := &LSMRepository{
+		opts:       opts.withDefaults(),
 		memTable:   NewMemTable(),
 		storageDir: storageDir,
 		sstables:   []*SSTable{},
+		snapshots:  make(map[uint64]int),
+
+		compactTrigger: make(chan struct{}, 1),
+		stopCompaction: make(chan struct{}),
+		workerDone:     make(chan struct{}),
+	}
+	repo.tableCache = newTableCache(repo.opts.MaxOpenFiles, repo.opts.MmapReads)
+	if repo.opts.BlockCacheSize > 0 {
+		repo.blockCache = newBlockCache(repo.opts.BlockCacheSize)
+	}
+	repo.flushed = sync.NewCond(&repo.mu)
+	repo.drained = sync.NewCond(&repo.mu)
+	repo.pubCond = sync.NewCond(&repo.pubMu)
+	repo.catalog.kv = repo
+
+	// The MANIFEST says which tables are live; a directory from before it existed is adopted as is
+	vs, exists, err := loadManifest(storageDir)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := importLegacyTables(storageDir, vs); err != nil {
+			return nil, err
+		}
 	}
+	repo.nextFile.Store(vs.nextFile)
+	repo.lastSeq.Store(vs.lastSeq)
 
-	walPath := storageDir + "/wal.log"
-	if _, err := os.Stat(walPath); err == nil {
+	// Replay whatever WAL segments the last run left behind (a crash, or a flush that never finished)
+	// and persist them as one SSTable right away, so this run starts from an empty MemTable.
+	// Segments below the MANIFEST's log number were flushed already, they just weren't deleted yet.
+	segments, lastLogNum, err := listWALSegments(storageDir)
+	if err != nil {
+		return nil, err
+	}
+	var replay []walSegment
+	for _, seg := range segments {
+		if seg.num >= vs.logNum {
+			replay = append(replay, seg)
+		}
+	}
+	if len(replay) > 0 {
 		fmt.Println("FYI: Found existing WAL. Attempting recovery...")
-		if err := repo.recoverFromWAL(walPath); err != nil {
+	}
+	recovered := NewMemTable()
+	for i, seg := range replay {
+		intact, err := repo.recoverFromWAL(seg.path, recovered)
+		if err != nil {
+			return nil, fmt.Errorf("WAL recovery failed: %w", err)
+		}
+		if !intact {
+			// Later segments are intact, but an unsynced tail before them was lost: replaying
+			// them would bring back later writes with earlier ones missing
+			repo.discardWAL(replay[i+1:])
+			break
+		}
+	}
+	if recovered.Size() > 0 {
+		sst, err := repo.writeMemTable(recovered)
+		if err != nil {
 			return nil, fmt.Errorf("WAL recovery failed: %w", err)
 		}
+		vs.apply(versionEdit{Added: []tableInfo{sst.info()}, LastSeq: sst.LargestSeq})
 	}
+	vs.logNum = max(vs.logNum, lastLogNum+1)
+	vs.nextFile = repo.nextFile.Load()
+	repo.visibleSeq.Store(repo.lastSeq.Load())
+
+	// Whatever a directory from before the MANIFEST holds was written before databases existed.
+	// The flag goes into the snapshot, so a crash before the migration below just repeats it.
+	if !exists && len(vs.tables) > 0 {
+		vs.legacyKeys = true
+	}
+
+	// Compact the edit log into a single snapshot. From here on the MANIFEST covers
+	// everything the old segments held.
+	if repo.manifest, err = writeManifest(storageDir, vs); err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		os.Remove(seg.path)
+	}
+	if err := removeOrphans(storageDir, vs); err != nil {
+		repo.manifest.Close()
+		return nil, err
+	}
+
+	for _, info := range vs.tables {
+		sst := &SSTable{
+			Filename:    filepath.Join(storageDir, info.Name),
+			Level:       info.Level,
+			SmallestSeq: info.SmallestSeq,
+			LargestSeq:  info.LargestSeq,
+			SmallestKey: info.SmallestKey,
+			LargestKey:  info.LargestKey,
+			Size:        info.Size,
+			format:      info.Format,
+			run:         info.Run,
+		}
+		repo.attach(sst, info.Num)
+		err := sst.LoadMetadata()
+		if err == nil && repo.opts.ParanoidChecks {
+			err = sst.verify()
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				repo.manifest.Close()
+				return nil, fmt.Errorf("MANIFEST lists %s but the file is missing", info.Name)
+			}
+			if repo.opts.ParanoidChecks {
+				repo.manifest.Close()
+				return nil, fmt.Errorf("paranoid checks: %w", err)
+			}
+			// Keep the table: its reads fail loudly instead of the keys it holds going missing
+			fmt.Printf("❌ Failed to load metadata for %s: %v\n", info.Name, err)
+			sst.err = err
+		}
+		if info.Size == 0 {
+			if err := sst.loadKeyRange(); err != nil {
+				fmt.Printf("❌ Failed to read the key range of %s: %v\n", info.Name, err)
+			}
+		} else {
+			sst.keyRange = true // read from the file above, or as the MANIFEST recorded it
+		}
+		sst.ref() // the tree's reference
+		repo.sstables = append(repo.sstables, sst)
+	}
+	sortTables(repo.sstables)
+	repo.tablesChanged()
 
-	wal, err := NewWAL(storageDir + "/wal.log")
+	if vs.legacyKeys {
+		if err := repo.migrateLegacyKeys(); err != nil {
+			repo.manifest.Close()
+			return nil, fmt.Errorf("migrating legacy rows: %w", err)
+		}
+	}
+
+	repo.logNum = vs.logNum
+	wal, err := repo.openWAL(repo.logNum)
 	if err != nil {
+		repo.manifest.Close()
 		return nil, err
 	}
 	repo.wal = wal
-	files, err := os.ReadDir(storageDir)
+	return repo, nil
+}
+
+// Close stops the compaction worker (a compaction in progress is abandoned, its inputs stay
+// live) and waits for it, waits for an in-flight background flush, then closes the active WAL
+// segment. Whatever is still in the MemTable is replayed from that segment on the next open.
+func (r *LSMRepository) Close() error {
+	r.stopOnce.Do(func() { close(r.stopCompaction) })
+	if r.workerRunning.Load() {
+		<-r.workerDone
+	}
+	// A manual Compact may still be running: it sees the stop channel too
+	r.compactMu.Lock()
+	defer r.compactMu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.imm != nil && r.bgErr == nil {
+		r.flushed.Wait()
+	}
+	err := r.wal.Close()
+	if mErr := r.manifest.Close(); err == nil {
+		err = mErr
+	}
+	r.tableCache.close()
+	return err
+}
+
+// WAL segments are numbered so recovery can replay them in write order.
+// "wal.log" is the single, unnumbered log older versions wrote; it sorts first.
+func (r *LSMRepository) walPath(num uint64) string {
+	return filepath.Join(r.storageDir, fmt.Sprintf("wal_%06d.log", num))
+}
+
+// openWAL creates segment num. Its directory entry is fsynced before any write goes to it:
+// otherwise a power loss could take the whole segment, writes acknowledged as durable included.
+func (r *LSMRepository) openWAL(num uint64) (*WAL, error) {
+	wal, err := NewWALWithSync(r.walPath(num), r.opts.SyncMode, r.opts.SyncInterval)
 	if err != nil {
 		return nil, err
 	}
-	var loadedSSTs []*SSTable
+	if err := syncDir(r.storageDir); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+type walSegment struct {
+	num  uint64
+	path string
+}
+
+func listWALSegments(dir string) ([]walSegment, uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var segments []walSegment
+	var last uint64
 	for _, f := range files {
-		if filepath.Ext(f.Name()) == ".db" {
-			fullPath := filepath.Join(storageDir, f.Name())
-			sst := &SSTable{Filename: fullPath}
-			if err := sst.LoadMetadata(); err != nil {
-            fmt.Printf("❌ Failed to load metadata for %s: %v\n", f.Name(), err)
-        	}
-			loadedSSTs = append(loadedSSTs, sst)
+		var num uint64
+		if f.Name() == "wal.log" {
+			num = 0
+		} else if _, err := fmt.Sscanf(f.Name(), "wal_%d.log", &num); err != nil {
+			continue
 		}
+		segments = append(segments, walSegment{num, filepath.Join(dir, f.Name())})
+		last = max(last, num)
 	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].num < segments[j].num })
+	return segments, last, nil
+}
 
-	sort.Slice(loadedSSTs, func(i, j int) bool {
-		return loadedSSTs[i].Filename > loadedSSTs[j].Filename
-	})
+// RecoveryReport describes what opening the repository replayed from the WAL.
+type RecoveryReport struct {
+	Segments       int   // WAL segments found on disk
+	Recovered      int   // records replayed into the MemTable
+	Discarded      int   // records dropped because they were torn or failed their checksum
+	TruncatedBytes int64 // bytes cut from the tails of damaged segments
+}
 
-	repo.sstables = loadedSSTs
-	return repo, nil
+// RecoveryReport returns what the last open recovered from the WAL.
+func (r *LSMRepository) RecoveryReport() RecoveryReport {
+	return r.recovery
 }
 
+// CompressionStats returns how well the SSTable blocks written since open compressed.
+func (r *LSMRepository) CompressionStats() CompressionStats {
+	return r.compression.snapshot()
+}
 
-func (r *LSMRepository) Close() error {
-	return r.wal.Close()
+// CacheStats returns the hits and misses of the block and table caches since open.
+func (r *LSMRepository) CacheStats() CacheStats {
+	stats := CacheStats{
+		TableHits:   r.tableCache.hits.Load(),
+		TableMisses: r.tableCache.misses.Load(),
+	}
+	stats.OpenFiles, stats.MappedFiles = r.tableCache.openFiles()
+	if r.blockCache != nil {
+		stats.BlockHits = r.blockCache.hits.Load()
+		stats.BlockMisses = r.blockCache.misses.Load()
+		stats.BlockBytes = r.blockCache.size()
+	}
+	return stats
 }
-func (r *LSMRepository) recoverFromWAL(walPath string) error {
 
-	f, err := os.Open(walPath)
-	if err != nil {
+// Tables lists the live SSTables in search order: level 0 newest first, then level by level
+// in key order.
+func (r *LSMRepository) Tables() []SSTableInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tables := make([]SSTableInfo, 0, len(r.sstables))
+	for _, sst := range r.sstables {
+		tables = append(tables, SSTableInfo{
+			Name:        filepath.Base(sst.Filename),
+			Level:       sst.Level,
+			Size:        sst.Size,
+			Entries:     sst.entries,
+			SmallestKey: sst.SmallestKey,
+			LargestKey:  sst.LargestKey,
+			SmallestSeq: sst.SmallestSeq,
+			LargestSeq:  sst.LargestSeq,
+		})
+	}
+	return tables
+}
+
+// FilterStats reports, for every live table, what its key range and Bloom filter spared it
+// since open.
+func (r *LSMRepository) FilterStats() []FilterStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stats := make([]FilterStats, 0, len(r.sstables))
+	for _, sst := range r.sstables {
+		stats = append(stats, FilterStats{
+			Table:          filepath.Base(sst.Filename),
+			Level:          sst.Level,
+			Negatives:      sst.filterNegatives.Load(),
+			FalsePositives: sst.filterFalsePositives.Load(),
+			PrefixSkips:    sst.prefixSkips.Load(),
+			RangeSkips:     sst.rangeSkips.Load(),
+		})
+	}
+	return stats
+}
+
+// attach numbers a table and hands it the repository's caches, before anything reads it.
+func (r *LSMRepository) attach(sst *SSTable, num uint64) {
+	sst.num = num
+	sst.files, sst.bcache = r.tableCache, r.blockCache
+}
+
+// checkTable reads a table that was just written back in full under ParanoidChecks, so a bad
+// disk or a bug is caught before the table is published. A table that fails is deleted.
+func (r *LSMRepository) checkTable(sst *SSTable) error {
+	if !r.opts.ParanoidChecks {
+		return nil
+	}
+	if err := sst.verify(); err != nil {
+		sst.discard()
 		return err
 	}
+	return nil
+}
+
+func (r *LSMRepository) tableOptions() tableOptions {
+	return r.opts.tableOptions(&r.compression)
+}
+
+// recoverFromWAL replays one segment into mem. It stops at the first torn or corrupt record
+// (everything after it is suspect, a crash only ever damages the tail) and truncates the
+// file there, so a half-written record can never fail the open. intact is false if it did.
+func (r *LSMRepository) recoverFromWAL(walPath string, mem *MemTable) (intact bool, err error) {
+	f, err := os.OpenFile(walPath, os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
 	defer f.Close()
 
-	var loadedCount int
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
 
-	for {
-		var keyLen int32
-		var valLen int32
+	var loadedCount, discarded int
+	var goodEnd int64
+	if filepath.Base(walPath) == "wal.log" {
+		loadedCount, goodEnd, discarded = replayLegacyWAL(f, func(b *WriteBatch) { r.applyRecovered(mem, b) })
+	} else {
+		wr := newWALReader(f)
+		for {
+			payload, err := wr.next()
+			if err == io.EOF {
+				break // Finished reading WAL
+			}
+			var batch *WriteBatch
+			if err == nil {
+				batch, err = decodeBatch(payload)
+			}
+			if err != nil {
+				discarded = wr.countRemaining()
+				fmt.Printf("⚠️ %s: %v at offset %d, discarding the rest of the segment\n", filepath.Base(walPath), err, wr.offset)
+				break
+			}
 
-		// Read Key Length
-		if err := binary.Read(f, binary.LittleEndian, &keyLen); err == io.EOF {
-			break // Finished reading WAL
-		} else if err != nil {
-			return err
+			//Put directly into MemTable
+			// We use the MemTable directly to avoid writing to the WAL again
+			r.applyRecovered(mem, batch)
+			loadedCount++
 		}
+		goodEnd = wr.offset
+	}
 
-		// Read Value Length
-		if err := binary.Read(f, binary.LittleEndian, &valLen); err != nil {
-			return err
+	if goodEnd < stat.Size() {
+		if err := f.Truncate(goodEnd); err != nil {
+			return false, fmt.Errorf("failed to truncate damaged WAL tail: %w", err)
 		}
+		r.recovery.TruncatedBytes += stat.Size() - goodEnd
+	}
+	r.recovery.Segments++
+	r.recovery.Recovered += loadedCount
+	r.recovery.Discarded += discarded
 
-		//Read Data
-		key := make([]byte, keyLen)
-		val := make([]byte, valLen)
-		if _, err := io.ReadFull(f, key); err != nil {
-			return err
-		}
-		if _, err := io.ReadFull(f, val); err != nil {
-			return err
-		}
+	if loadedCount > 0 || discarded > 0 {
+		fmt.Printf("🔄 Recovered %d records from %s (%d discarded).\n", loadedCount, filepath.Base(walPath), discarded)
+	}
+	return goodEnd == stat.Size() && discarded == 0, nil
+}
 
-		//Put directly into MemTable
-		// We use the map directly to avoid writing to the WAL again
-		r.memTable.Put(string(key), val)
-		loadedCount++
+// discardWAL skips the segments after a damaged one: their records are counted as discarded,
+// and the files go with the others once the recovered MemTable is safe in an SSTable.
+func (r *LSMRepository) discardWAL(segments []walSegment) {
+	for _, seg := range segments {
+		r.recovery.Segments++
+		f, err := os.Open(seg.path)
+		if err != nil {
+			continue
+		}
+		n := newWALReader(f).countRecords()
+		f.Close()
+		r.recovery.Discarded += n
+		fmt.Printf("⚠️ %s: follows a damaged segment, discarding its %d records\n", filepath.Base(seg.path), n)
 	}
+}
 
-	if loadedCount > 0 {
-		fmt.Printf("🔄 Recovered %d records from WAL.\n", loadedCount)
+// applyRecovered replays a batch with the sequence numbers it was logged with and moves the
+// counter past them, so new writes always sort after recovered ones. Batches without a
+// sequence number (the legacy wal.log, or a WAL written directly) are numbered in replay order.
+func (r *LSMRepository) applyRecovered(mem *MemTable, b *WriteBatch) {
+	if b.seq == 0 {
+		n := uint64(b.Len())
+		b.seq = r.lastSeq.Add(n) - n + 1
+	} else if last := b.lastSeq(); last > r.lastSeq.Load() {
+		r.lastSeq.Store(last)
 	}
-	return nil
+	mem.apply(b)
 }
 
-func (r *LSMRepository) InsertRow(tableName string, row domain.Row) error {
-	jsonRow, err := json.Marshal(row)
-	if err != nil {
-		return err
+// replayLegacyWAL reads the checksum-less wal.log format ([keyLen][valLen][key][value]) written
+// by older versions. Without a CRC the best we can do is stop at a record cut short.
+func replayLegacyWAL(f *os.File, apply func(*WriteBatch)) (loaded int, goodEnd int64, discarded int) {
+	br := bufio.NewReader(f)
+	for {
+		var header [8]byte
+		if n, err := io.ReadFull(br, header[:]); err != nil {
+			if n > 0 {
+				discarded = 1
+			}
+			return
+		}
+		keyLen := int32(binary.LittleEndian.Uint32(header[0:4]))
+		valLen := int32(binary.LittleEndian.Uint32(header[4:8]))
+		if keyLen < 0 || keyLen > walMaxRecord || valLen < tombstoneLen || valLen > walMaxRecord {
+			discarded = 1
+			return
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			discarded = 1
+			return
+		}
+		recordLen := int64(8 + keyLen)
+		b := NewWriteBatch()
+		if valLen == tombstoneLen {
+			b.Delete(string(key))
+		} else {
+			val := make([]byte, valLen)
+			if _, err := io.ReadFull(br, val); err != nil {
+				discarded = 1
+				return
+			}
+			b.Put(string(key), val)
+			recordLen += int64(valLen)
+		}
+		apply(b)
+		goodEnd += recordLen
+		loaded++
 	}
+}
 
-	// Using the first value as the primary key for the key generation
-	key := fmt.Sprintf("%s:%v", tableName, row[0])
+// newTableFile hands out the number and path of the next SSTable. The name says nothing
+// about the table's age or liveness; the MANIFEST does.
+func (r *LSMRepository) newTableFile() (uint64, string) {
+	num := r.nextFile.Add(1) - 1
+	return num, filepath.Join(r.storageDir, fmt.Sprintf("sst_%06d.db", num))
+}
 
-	if err := r.wal.Append(key, jsonRow); err != nil {
-		return err
+// writeMemTable persists a frozen MemTable as a new level-0 SSTable, but doesn't publish it.
+func (r *LSMRepository) writeMemTable(mem *MemTable) (*SSTable, error) {
+	num, filename := r.newTableFile()
+	// The skiplist is already sorted, so the SSTable is written in one streaming pass
+	it := mem.NewIterator()
+	it.SeekToFirst()
+	sst, err := writeSSTable(it, filename, r.tableOptions())
+	if err != nil {
+		return nil, err
 	}
-	r.memTable.Put(key, jsonRow)
-	return nil
+	r.attach(sst, num)
+	if err := r.checkTable(sst); err != nil {
+		return nil, err
+	}
+	sst.SmallestSeq, sst.LargestSeq = mem.seqRange()
+	return sst, nil
 }
 
-func (r *LSMRepository) Flush() error {
-	r.memTable.mu.Lock()
-	defer r.memTable.mu.Unlock()
+// rotate freezes the active MemTable and starts a fresh one on a new WAL segment.
+// Without force it only rotates a MemTable that reached MemTableSize (another writer
+// may have rotated already). Returns the frozen MemTable and its WAL, or nil if nothing rotated.
+func (r *LSMRepository) rotate(force bool) (*MemTable, *WAL, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if r.memTable.size == 0 {
-		return nil
+	// Only one immutable MemTable at a time: if the previous one is still being
+	// flushed, the writer that filled this one waits (a write stall).
+	for r.imm != nil && r.bgErr == nil {
+		r.flushed.Wait()
+	}
+	if r.bgErr != nil {
+		return nil, nil, r.bgErr
+	}
+
+	size := r.memTable.Size()
+	if size == 0 || (!force && size < r.opts.MemTableSize) {
+		return nil, nil, nil
 	}
 
-	filename := fmt.Sprintf("%s/sst_%d.db", r.storageDir, time.Now().UnixNano())
-	newSST, err := WriteSSTable(r.memTable.data, filename)
+	wal, err := r.openWAL(r.logNum + 1)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if newSST.Filter == nil {
-		fmt.Printf("⚠️ WriteSSTable didn't return a filter for %s. Attempting to load...\n", filename)
+	imm, immWAL := r.memTable, r.wal
+	r.logNum++
+	r.imm = imm
+	r.memTable = NewMemTable()
+	r.wal = wal
+	return imm, immWAL, nil
+}
 
-		// Force load and CHECK THE ERROR
-		if err := newSST.LoadFilter(); err != nil {
-			fmt.Printf("❌ LoadFilter FAILED: %v\n", err)
-			return fmt.Errorf("failed to load filter: %w", err)
+// flushImmutable writes the frozen MemTable to an SSTable, publishes it, and drops its WAL segment.
+// Reads keep consulting imm until the new table is in the list, so nothing is ever invisible.
+func (r *LSMRepository) flushImmutable(imm *MemTable, immWAL *WAL) error {
+	newSST, err := r.writeMemTable(imm)
+	if err == nil {
+		// Only one MemTable is ever frozen, so the active segment is the one right after imm's:
+		// once this edit is logged every segment below it is redundant.
+		r.mu.RLock()
+		logNum := r.logNum
+		r.mu.RUnlock()
+		// The file is fsynced, its directory entry isn't yet: it must be before the MANIFEST
+		// names it, or a power loss could leave the MANIFEST listing a file that isn't there
+		// (with the WAL segment that held its data already gone)
+		err = syncDir(r.storageDir)
+		if err == nil {
+			err = r.manifest.logEdit(versionEdit{
+				LogNum:   logNum,
+				NextFile: r.nextFile.Load(),
+				LastSeq:  newSST.LargestSeq,
+				Added:    []tableInfo{newSST.info()},
+			})
 		}
-
-		if newSST.Filter == nil {
-			fmt.Printf("❌ Filter is STILL nil after loading!\n")
-		} else {
-			fmt.Printf("✅ Filter loaded successfully from disk.\n")
+		if err != nil {
+			newSST.discard()
 		}
 	}
 
 	r.mu.Lock()
-
+	if err != nil {
+		r.bgErr = fmt.Errorf("flush failed: %w", err)
+		r.flushed.Broadcast()
+		r.mu.Unlock()
+		return r.bgErr
+	}
 	// Prepend the new file (since it's the newest)
+	newSST.ref()
 	r.sstables = append([]*SSTable{newSST}, r.sstables...)
+	r.tablesChanged()
+	r.imm = nil
+	r.flushed.Broadcast()
 	r.mu.Unlock()
-
-	r.memTable.data = make(map[string][]byte)
-	r.memTable.size = 0
-	if err := r.wal.Truncate(); err != nil {
-		return fmt.Errorf("failed to truncate WAL: %w", err)
+	// One more level-0 table: let the worker see whether that calls for a compaction (until it
+	// has looked, writers are throttled as if it did)
+	r.compactPending.Store(true)
+	r.triggerCompaction()
+
+	// Every record in that segment is in the SSTable now
+	immWAL.Close()
+	if err := os.Remove(immWAL.path); err != nil {
+		return fmt.Errorf("failed to remove WAL segment: %w", err)
 	}
 	return nil
+}
 
+// Flush synchronously writes the active MemTable to an SSTable, even if it isn't full.
+func (r *LSMRepository) Flush() error {
+	imm, immWAL, err := r.rotate(true)
+	if err != nil || imm == nil {
+		return err
+	}
+	return r.flushImmutable(imm, immWAL)
 }
 
-func (r *LSMRepository) Query(tableName string, conditions string) ([]domain.Row, error) {
-	key := fmt.Sprintf("%s:%s", tableName, conditions)
-	// check reading from memtable
-	r.memTable.mu.RLock()
+// Write commits every operation of the batch atomically with respect to crashes: it is
+// logged as a single WAL record, then applied to the MemTable. This is the raw write path
+// shared by every Repository method. Once the MemTable is over MemTableSize it is handed
+// to a background flush.
+func (r *LSMRepository) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := r.throttle(); err != nil {
+		return err
+	}
 
-	if val, ok := r.memTable.data[key]; ok {
-		r.memTable.mu.RUnlock() // RUnlock here is not defer because if we stopped writing till we read from sstable and disk it will cose alot in terms of performance
-		var row domain.Row
-		if err := json.Unmarshal(val, &row); err != nil {
-			return nil, err
+	r.mu.RLock()
+	if r.bgErr != nil {
+		r.mu.RUnlock()
+		return r.bgErr
+	}
+	// Number the batch while holding mu, so all of it lands in the MemTable (and WAL segment)
+	// that was active when it got its numbers: MemTables never overlap in sequence ranges.
+	n := uint64(batch.Len())
+	batch.seq = r.lastSeq.Add(n) - n + 1
+	err := r.wal.AppendBatch(batch)
+	if err == nil {
+		r.memTable.apply(batch)
+	}
+	full := r.memTable.Size() >= r.opts.MemTableSize
+	r.mu.RUnlock()
+
+	// Even a failed batch must publish its numbers, or every later write would wait for it forever
+	r.publish(batch)
+
+	if err != nil || !full {
+		return err
+	}
+	imm, immWAL, err := r.rotate(false)
+	if err != nil || imm == nil {
+		return err
+	}
+	go func() {
+		if err := r.flushImmutable(imm, immWAL); err != nil {
+			fmt.Println("❌ Background flush error:", err)
 		}
-		return []domain.Row{row}, nil
+	}()
+	return nil
+}
+
+// throttle holds writers back while compaction can't keep up with level 0: past
+// L0SlowdownTrigger tables each write is delayed by a millisecond, at L0StopTrigger writes
+// stop until a compaction brings the count down. Reads get slower with every level-0 table
+// (they all have to be searched), so trading some write latency keeps them bounded.
+// It only kicks in while the worker is running and the strategy has compaction work for it:
+// if nothing can be compacted (a size-tiered tree with no runs alike), holding writes back
+// would not help. Writers never queue a pass themselves; flushes do.
+func (r *LSMRepository) throttle() error {
+	if int(r.l0Runs.Load()) < r.opts.L0SlowdownTrigger || !r.workerRunning.Load() || !r.compactPending.Load() {
+		return nil // fast path
 	}
-	r.memTable.mu.RUnlock()
-	// check reading from sstable
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	busy := func() bool {
+		return r.workerRunning.Load() && r.compactPending.Load() && (r.compactQueued.Load() || r.compacting.Load())
+	}
+	if int(r.l0Runs.Load()) >= r.opts.L0StopTrigger && busy() {
+		r.stalls.Add(1)
+		for int(r.l0Runs.Load()) >= r.opts.L0StopTrigger && busy() && r.bgErr == nil {
+			r.drained.Wait()
+		}
+		return r.bgErr
+	}
+	if busy() {
+		r.slowdowns.Add(1)
+		r.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		r.mu.Lock()
+	}
+	return r.bgErr
+}
+
+// tablesChanged is called (with mu held) whenever r.sstables changes.
+func (r *LSMRepository) tablesChanged() {
+	r.l0Runs.Store(int32(level0Runs(r.sstables)))
+	r.drained.Broadcast()
+}
+
+func (r *LSMRepository) put(key string, value []byte) error {
+	b := NewWriteBatch()
+	b.Put(key, value)
+	return r.Write(b)
+}
+
+// Delete writes a tombstone for key. The old versions stay in the SSTables until
+// compaction, but every read path stops at the tombstone and reports the key as missing.
+func (r *LSMRepository) Delete(key string) error {
+	b := NewWriteBatch()
+	b.Delete(key)
+	return r.Write(b)
+}
+
+// current returns the live MemTables (newest first) and SSTables as one consistent view,
+// with the sequence number of the last write visible in it. It takes a reference on every
+// SSTable so a compaction can't delete the files while they are being read: hand them back
+// with releaseTables.
+//
+// A plain read must use that seq, not one loaded before: a compaction installing its outputs
+// in between may have dropped versions only visible at the older number (it can't see the
+// reader in smallestSnapshot). Installing takes mu, so a seq read with the tables is at
+// least what any compaction those tables came out of had to keep.
+func (r *LSMRepository) current() ([]*MemTable, []*SSTable, uint64) {
 	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seq := r.visibleSeq.Load()
+
+	mems := []*MemTable{r.memTable}
+	if r.imm != nil {
+		mems = append(mems, r.imm)
+	}
 	activeFiles := make([]*SSTable, len(r.sstables))
 	copy(activeFiles, r.sstables)
-	r.mu.RUnlock()
-
 	for _, sst := range activeFiles {
-		if sst.Filter == nil {
-			fmt.Printf("⚠️ WARNING: Filter is NIL for %s\n", sst.Filename)
-		} else {
-			// DEBUG: Check what the filter says
-			isPresent := sst.Filter.Contains([]byte(key))
-			// fmt.Printf("DEBUG: Filter check for %s in %s: %v\n", key, sst.Filename, isPresent)
+		sst.ref()
+	}
+	return mems, activeFiles, seq
+}
 
-			if !isPresent {
-				continue // Optimization working!
-			}
+// Get is a point lookup on a raw key. The MemTables are checked first, then the
+// SSTables in search order. Sequence ranges of MemTables and level-0 tables never overlap
+// and compaction output is older than all of them, so the first visible version found is
+// the newest one. If that version is a tombstone the key is reported as missing.
+func (r *LSMRepository) Get(key string) ([]byte, bool, error) {
+	mems, activeFiles, seq := r.current()
+	defer releaseTables(activeFiles)
+	return getResult(search(mems, activeFiles, key, seq))
+}
+
+// getAt is Get as of sequence number seq (a snapshot's): newer versions are ignored.
+func (r *LSMRepository) getAt(key string, seq uint64) ([]byte, bool, error) {
+	return getResult(r.lookup(key, seq))
+}
+
+// getResult turns the version a lookup found into what Get returns.
+func getResult(entry Entry, found bool, err error) ([]byte, bool, error) {
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return entry.Value, !entry.Tombstone, nil
+}
+
+// lookup returns the newest version of key with Seq <= seq, tombstones included. seq must be
+// a snapshot's, or otherwise kept safe from compaction (see current).
+func (r *LSMRepository) lookup(key string, seq uint64) (Entry, bool, error) {
+	mems, activeFiles, _ := r.current()
+	defer releaseTables(activeFiles)
+	return search(mems, activeFiles, key, seq)
+}
+
+// search looks key up in a view taken by current.
+func search(mems []*MemTable, activeFiles []*SSTable, key string, seq uint64) (Entry, bool, error) {
+	// check reading from memtable (active, then the one being flushed)
+	for _, mem := range mems {
+		if entry, ok := mem.getAt(key, seq); ok {
+			return entry, true, nil
 		}
-		val, found, err := sst.Search(key)
+	}
 
+	// check reading from sstable
+	for _, sst := range activeFiles {
+		// Search checks the key range and the Bloom filter first, so misses never touch the disk
+		entry, found, err := sst.searchAt(key, seq)
 		if err != nil {
-			return nil, err
+			return Entry{}, false, err
 		}
-
 		if found {
-			var row domain.Row
-			if err := json.Unmarshal(val, &row); err != nil {
-				return nil, err
-			}
-			return []domain.Row{row}, nil
+			return entry, true, nil
 		}
-
 	}
-	return []domain.Row{}, nil
+	return Entry{}, false, nil
 }
-
-func (r *LSMRepository) CreateTable(t domain.TableMetaData) error { return nil }
-func (r *LSMRepository) DropDatabase() error                      { return nil }
@@ -0,0 +1,280 @@
+package db
+
+import (
+	"chill-db/internal/domain"
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLSMRepositoryCatalog(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateDatabase(ctx, "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateDatabase(ctx, "shop"); err == nil {
+		t.Fatal("expected duplicate database to fail")
+	}
+	if err := repo.CreateTable(ctx, "missing", benchUsers); err == nil {
+		t.Fatal("expected CreateTable on a missing database to fail")
+	}
+	if err := repo.CreateTable(ctx, "shop", benchUsers); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.InsertRow(ctx, "shop", "orders", domain.Row{"1"}); err == nil {
+		t.Fatal("expected insert into a missing table to fail")
+	}
+	for _, row := range []domain.Row{{"2", "bob", "b@x"}, {"1", "alice", "a@x"}} {
+		if err := repo.InsertRow(ctx, "shop", "users", row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Half the rows on disk, half in the MemTable
+	if err := repo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.InsertRow(ctx, "shop", "users", domain.Row{"2", "bobby", "b@x"}); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	// Reopen: the catalog and rows must come back from the SSTable + WAL
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	dbs, err := repo.ListDatabases(ctx)
+	if err != nil || !reflect.DeepEqual(dbs, []string{"shop"}) {
+		t.Fatalf("ListDatabases = %v, %v", dbs, err)
+	}
+	rows, err := repo.Query(ctx, "shop", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []domain.Row{{"1", "alice", "a@x"}, {"2", "bobby", "b@x"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("Query = %v, want %v", rows, want)
+	}
+
+	if err := repo.DropDatabase(ctx, "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if dbs, _ := repo.ListDatabases(ctx); len(dbs) != 0 {
+		t.Fatalf("database still listed after drop: %v", dbs)
+	}
+	// Re-creating the database must not resurrect the old tables
+	if err := repo.CreateDatabase(ctx, "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Query(ctx, "shop", "users"); err == nil {
+		t.Fatal("expected dropped table to be gone")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := repo.ListDatabases(cancelled); err == nil {
+		t.Fatal("expected cancelled context to abort")
+	}
+}
+
+// A row write racing DropDatabase must either land before the drop (and go with it) or fail:
+// it may never outlive the database in an orphaned table.
+func TestInsertRacingDropDatabase(t *testing.T) {
+	// Without fsyncs the writers get plenty done between two catalog changes
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{SyncMode: SyncNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	ctx := context.Background()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				pk := fmt.Sprintf("%d-%d", w, i)
+				switch i % 3 {
+				case 0:
+					repo.InsertRow(ctx, "shop", "users", domain.Row{pk})
+				case 1:
+					repo.InsertRows(ctx, "shop", "users", []domain.Row{{pk}})
+				default:
+					repo.DeleteRow(ctx, "shop", "users", pk)
+				}
+			}
+		}(w)
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := 0; i < 30; i++ {
+		if err := repo.CreateDatabase(ctx, "shop"); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.CreateTable(ctx, "shop", benchUsers); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DropDatabase(ctx, "shop"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // give a write that checked the table before the drop time to land
+		keys, err := repo.scanKeys(ctx, rowPrefix("shop", "users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) > 0 {
+			t.Fatalf("round %d: %d rows outlived DropDatabase, e.g. %s", i, len(keys), keys[0])
+		}
+	}
+}
+
+func TestLSMRepositoryDelete(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustGet := func(key string, want string, wantFound bool) {
+		t.Helper()
+		val, found, err := repo.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != wantFound || string(val) != want {
+			t.Fatalf("Get(%s) = %q, %v; want %q, %v", key, val, found, want, wantFound)
+		}
+	}
+
+	repo.put("a", []byte("1"))
+	repo.put("b", []byte("2"))
+	repo.Flush() // old versions live in an SSTable
+
+	if err := repo.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	mustGet("a", "", false) // tombstone in the MemTable masks the SSTable
+	repo.Close()
+
+	// The tombstone must survive a WAL replay...
+	if repo, err = NewLSMRepository(dir); err != nil {
+		t.Fatal(err)
+	}
+	mustGet("a", "", false)
+	mustGet("b", "2", true)
+
+	// ...and a flush to its own SSTable
+	repo.Flush()
+	mustGet("a", "", false)
+
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.sstables) != 1 {
+		t.Fatalf("expected 1 table after compaction, got %d", len(repo.sstables))
+	}
+	data, err := repo.sstables[0].Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["a"]; ok {
+		t.Fatal("compaction kept a tombstone with no older table left to mask")
+	}
+	mustGet("b", "2", true)
+
+	// Delete after compaction, then re-insert
+	repo.Delete("b")
+	repo.Flush()
+	repo.put("b", []byte("3"))
+	mustGet("b", "3", true)
+	repo.Close()
+}
+
+func TestLSMRepositoryAutoFlush(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepositoryWithOptions(dir, Options{MemTableSize: 4 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers run alongside the writer and must never miss a key that was already written
+	var written atomic.Int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n := written.Load()
+			if n == 0 {
+				continue
+			}
+			key := fmt.Sprintf("k%05d", n-1)
+			if _, found, err := repo.Get(key); err != nil || !found {
+				t.Errorf("Get(%s) during flush = %v, %v", key, found, err)
+				return
+			}
+		}
+	}()
+
+	const total = 2000
+	value := []byte(strings.Repeat("x", 64))
+	for i := 0; i < total; i++ {
+		if err := repo.put(fmt.Sprintf("k%05d", i), value); err != nil {
+			t.Fatal(err)
+		}
+		written.Store(int64(i + 1))
+	}
+	close(done)
+	wg.Wait()
+
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.sstables) < 10 {
+		t.Fatalf("expected the MemTable to be flushed many times, got %d SSTables", len(repo.sstables))
+	}
+	// Only the active segment is left: flushed segments are removed
+	if segments, _ := filepath.Glob(filepath.Join(dir, "wal_*.log")); len(segments) != 1 {
+		t.Fatalf("expected 1 WAL segment, found %v", segments)
+	}
+
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	keys, err := repo.scanKeys(context.Background(), "k")
+	if err != nil || len(keys) != total {
+		t.Fatalf("after reopen found %d keys (%v), want %d", len(keys), err, total)
+	}
+}
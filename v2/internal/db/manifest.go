@@ -0,0 +1,276 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The MANIFEST is the source of truth for which SSTables make up the tree. Listing the
+// directory is not enough: a crash in the middle of a compaction leaves both the inputs
+// and the output on disk, and file names alone can't tell which ones are still live.
+//
+// It is a log of versionEdits framed like WAL records ([crc][length][JSON edit]). Every flush
+// and compaction appends one edit and fsyncs it BEFORE the change is published in memory, so
+// the edit is the commit point: a table that made it into the MANIFEST is live, anything
+// else in the directory is debris from a crash.
+//
+// On open the edits are replayed, the log is rewritten as one snapshot edit (MANIFEST.tmp +
+// rename, which is atomic), and every *.db file the snapshot doesn't mention is deleted.
+
+const (
+	manifestName    = "MANIFEST"
+	manifestVersion = 1 // format of the edits, recorded in the first one
+)
+
+// tableInfo is what the MANIFEST knows about one live SSTable.
+type tableInfo struct {
+	Name        string `json:"name"`         // file name inside the storage dir
+	Num         uint64 `json:"num"`          // allocation order, breaks ties between equal sequence ranges
+	Level       int    `json:"level"`        // 0 = flushed MemTable, 1.. = compaction output
+	SmallestSeq uint64 `json:"smallest_seq"` // sequence numbers of the oldest and newest write in the table
+	LargestSeq  uint64 `json:"largest_seq"`
+	SmallestKey string `json:"smallest_key,omitempty"` // key range and file size; missing for tables
+	LargestKey  string `json:"largest_key,omitempty"`  // logged before levels existed (filled in on open)
+	Size        int64  `json:"size,omitempty"`
+	Format      int    `json:"format,omitempty"` // data record format, sstFormatLegacy for adopted tables
+	Run         uint64 `json:"run,omitempty"`    // level 0: tables of one sorted run share it; 0 = a run on its own
+}
+
+// versionEdit is one change to the set of live tables. Counters only ever move forward,
+// so replaying edits takes the max of each.
+type versionEdit struct {
+	Version  int         `json:"version,omitempty"`   // only in the first edit of a MANIFEST
+	LogNum   uint64      `json:"log_num,omitempty"`   // WAL segments below this number are fully in SSTables
+	NextFile uint64      `json:"next_file,omitempty"` // next table number to hand out
+	LastSeq  uint64      `json:"last_seq,omitempty"`  // highest sequence number stored in an SSTable
+	Added    []tableInfo `json:"added,omitempty"`
+	Deleted  []string    `json:"deleted,omitempty"` // file names
+
+	// LegacyKeys marks a directory adopted from before databases existed: its rows still
+	// have to be moved into the catalog's layout (see migrateLegacyKeys), which then logs KeysMigrated.
+	LegacyKeys   bool `json:"legacy_keys,omitempty"`
+	KeysMigrated bool `json:"keys_migrated,omitempty"`
+}
+
+// versionSet is the state the edits add up to.
+type versionSet struct {
+	tables     map[string]tableInfo
+	logNum     uint64
+	nextFile   uint64
+	lastSeq    uint64
+	legacyKeys bool
+}
+
+func newVersionSet() *versionSet {
+	return &versionSet{tables: make(map[string]tableInfo), nextFile: 1}
+}
+
+func (v *versionSet) apply(e versionEdit) {
+	for _, name := range e.Deleted {
+		delete(v.tables, name)
+	}
+	for _, t := range e.Added {
+		v.tables[t.Name] = t
+	}
+	v.logNum = max(v.logNum, e.LogNum)
+	v.nextFile = max(v.nextFile, e.NextFile)
+	v.lastSeq = max(v.lastSeq, e.LastSeq)
+	v.legacyKeys = (v.legacyKeys || e.LegacyKeys) && !e.KeysMigrated
+}
+
+// snapshot is a single edit that rebuilds v from nothing.
+func (v *versionSet) snapshot() versionEdit {
+	e := versionEdit{Version: manifestVersion, LogNum: v.logNum, NextFile: v.nextFile, LastSeq: v.lastSeq, LegacyKeys: v.legacyKeys}
+	for _, t := range v.tables {
+		e.Added = append(e.Added, t)
+	}
+	sort.Slice(e.Added, func(i, j int) bool { return e.Added[i].Num < e.Added[j].Num })
+	return e
+}
+
+// manifest is the open MANIFEST file that edits are appended to.
+type manifest struct {
+	mu   sync.Mutex // flushes and compactions log edits concurrently
+	file *os.File
+}
+
+// loadManifest replays dir/MANIFEST. exists is false for a directory written before MANIFESTs existed.
+func loadManifest(dir string) (vs *versionSet, exists bool, err error) {
+	vs = newVersionSet()
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return vs, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	defer f.Close()
+
+	wr := newWALReader(f)
+	for first := true; ; first = false {
+		payload, err := wr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A torn last edit was never acknowledged, so the flush or compaction it describes
+			// didn't happen. Damage anywhere else would make us forget live tables: refuse to open.
+			if errors.Is(err, errWALTorn) || wr.countRemaining() == 1 {
+				fmt.Printf("⚠️ MANIFEST: %v at offset %d, ignoring the unfinished edit\n", err, wr.offset)
+				break
+			}
+			return nil, true, fmt.Errorf("manifest corrupt at offset %d: %w", wr.offset, err)
+		}
+
+		var edit versionEdit
+		if err := json.Unmarshal(payload, &edit); err != nil {
+			return nil, true, fmt.Errorf("manifest corrupt at offset %d: %w", wr.offset, err)
+		}
+		if first && edit.Version != manifestVersion {
+			return nil, true, fmt.Errorf("unsupported manifest version %d", edit.Version)
+		}
+		vs.apply(edit)
+	}
+	return vs, true, nil
+}
+
+// writeManifest atomically replaces dir/MANIFEST with a snapshot of vs and opens it for appending.
+func writeManifest(dir string, vs *versionSet) (*manifest, error) {
+	payload, err := json.Marshal(vs.snapshot())
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := filepath.Join(dir, manifestName+".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Write(appendRecord(nil, payload)); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, manifestName)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	// The rename itself lives in the directory: sync it too, or a crash could bring back the old MANIFEST
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{file: f}, nil
+}
+
+// logEdit appends one edit and fsyncs it. When it returns nil the change survives a crash.
+func (m *manifest) logEdit(edit versionEdit) error {
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.file.Write(appendRecord(nil, payload)); err != nil {
+		return fmt.Errorf("manifest write: %w", err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return fmt.Errorf("manifest sync: %w", err)
+	}
+	return nil
+}
+
+func (m *manifest) Close() error {
+	return m.file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// importLegacyTables adopts the *.db files of a directory written before MANIFESTs existed.
+// Their names end in a creation timestamp (sst_<nanos>.db, compacted_<nanos>.db), which is
+// the only age information they have: tables are numbered oldest first from it.
+func importLegacyTables(dir string, vs *versionSet) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type legacyTable struct {
+		name  string
+		nanos int64
+	}
+	var tables []legacyTable
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".db" {
+			continue
+		}
+		stem := strings.TrimSuffix(f.Name(), ".db")
+		nanos, _ := strconv.ParseInt(stem[strings.LastIndex(stem, "_")+1:], 10, 64)
+		tables = append(tables, legacyTable{f.Name(), nanos})
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].nanos != tables[j].nanos {
+			return tables[i].nanos < tables[j].nanos
+		}
+		return tables[i].name < tables[j].name
+	})
+
+	for _, t := range tables {
+		vs.tables[t.name] = tableInfo{Name: t.name, Num: vs.nextFile}
+		vs.nextFile++
+	}
+	if len(tables) > 0 {
+		fmt.Printf("📋 No MANIFEST found, adopted %d existing SSTables.\n", len(tables))
+	}
+	return nil
+}
+
+// removeOrphans deletes every table file the MANIFEST doesn't list: outputs of flushes or
+// compactions that crashed before their edit was logged, and inputs of compactions that
+// crashed after it.
+func removeOrphans(dir string, vs *versionSet) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".db" {
+			continue
+		}
+		if _, live := vs.tables[f.Name()]; live {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+		fmt.Printf("🧹 Removed orphan table %s\n", f.Name())
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tableFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// A crash after a compaction's MANIFEST edit but before its inputs are deleted must not
+// bring the inputs back: they hold versions the compaction already discarded.
+func TestManifestIgnoresStaleCompactionInputs(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.put("a", []byte("1"))
+	repo.Flush()
+	stale := repo.sstables[0].Filename
+	copyFile(t, stale, stale+".bak")
+
+	repo.Delete("a")
+	repo.put("b", []byte("2"))
+	repo.Flush()
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	// Put the old input back, plus a table no edit ever mentioned (a flush that crashed)
+	copyFile(t, stale+".bak", stale)
+	os.Remove(stale + ".bak")
+	copyFile(t, stale, filepath.Join(dir, "sst_999999.db"))
+
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	if _, found, _ := repo.Get("a"); found {
+		t.Fatal("deleted key resurrected from a stale table")
+	}
+	if v, _, _ := repo.Get("b"); string(v) != "2" {
+		t.Fatalf("b = %q, want 2", v)
+	}
+	if files := tableFiles(t, dir); len(files) != 1 || files[0] != repo.sstables[0].Filename {
+		t.Fatalf("orphans not collected: %v", files)
+	}
+	if repo.sstables[0].Level != 1 {
+		t.Fatalf("compaction output reopened at level %d, want 1", repo.sstables[0].Level)
+	}
+}
+
+func TestManifestOrdersTablesBySequence(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1", "2", "3"} {
+		repo.put("k", []byte(v))
+		repo.Flush()
+	}
+	repo.Close()
+
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	if v, _, _ := repo.Get("k"); string(v) != "3" {
+		t.Fatalf("k = %q, want the newest version 3", v)
+	}
+	for i := 1; i < len(repo.sstables); i++ {
+		if repo.sstables[i-1].SmallestSeq <= repo.sstables[i].LargestSeq {
+			t.Fatalf("tables out of order: %+v before %+v", repo.sstables[i-1].info(), repo.sstables[i].info())
+		}
+	}
+	// New writes continue after the recovered sequence numbers
+	repo.put("k", []byte("4"))
+	if _, largest := repo.memTable.seqRange(); largest <= repo.sstables[0].LargestSeq {
+		t.Fatalf("sequence number %d reused", largest)
+	}
+}
+
+func TestRetiredTableOutlivesOpenIterator(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	repo.put("a", []byte("1"))
+	repo.Flush()
+	repo.put("b", []byte("2"))
+	repo.Flush()
+	old := repo.sstables[1].Filename
+
+	it, err := repo.Scan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Fatalf("table deleted while an iterator still reads it: %v", err)
+	}
+
+	keys := 0
+	for ; it.Valid(); it.Next() {
+		keys++
+	}
+	if it.Err() != nil || keys != 2 {
+		t.Fatalf("iterator saw %d keys (%v), want 2", keys, it.Err())
+	}
+	it.Close()
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("retired table still on disk after the last reader closed: %v", err)
+	}
+}
+
+// Directories written before the MANIFEST existed are adopted, ordered by the timestamp in
+// the file names (not by name: "compacted_" would sort before "sst_").
+func TestManifestAdoptsLegacyTables(t *testing.T) {
+	dir := t.TempDir()
+	// The record format of the time: [keyLen][valLen][key][value], no sequence number
+	write := func(name, value string) {
+		var data []byte
+		data = binary.LittleEndian.AppendUint32(data, 1)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(value)))
+		data = append(data, "k"+value...)
+
+		bf := NewBloomFilter(10, 7)
+		bf.Add("k")
+		filter := bf.Encode()
+		index, _ := EncodeIndex([]IndexEntry{{Key: "k", Offset: 0}})
+		data = append(append(data, filter...), index...)
+		data = binary.LittleEndian.AppendUint64(data, uint64(len(filter)))
+		data = binary.LittleEndian.AppendUint64(data, uint64(len(index)))
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("sst_100.db", "old")
+	write("compacted_200.db", "new")
+
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	if v, _, _ := repo.Get("k"); string(v) != "new" {
+		t.Fatalf("k = %q, want new", v)
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); err != nil {
+		t.Fatalf("MANIFEST not written: %v", err)
+	}
+}
+
+func TestLegacyRowsMoveIntoDefaultDatabase(t *testing.T) {
+	dir := t.TempDir()
+	// wal.log of the time, holding the row users:999 -> ["999","SecretAgent","topsecret@cia.gov"]
+	record := func(key, value string) []byte {
+		var data []byte
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(key)))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(value)))
+		return append(append(data, key...), value...)
+	}
+	wal := append(record("users:999", `["999","SecretAgent","topsecret@cia.gov"]`), record("stray", "x")...)
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	// The second open must find the rows where the first one put them, not migrate them again
+	for i := 0; i < 2; i++ {
+		repo, err := NewLSMRepository(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row, found, err := repo.GetRow(ctx, LegacyDatabase, "users", "999")
+		if err != nil || !found || row[1] != "SecretAgent" {
+			t.Fatalf("open %d: row = %v %v %v", i, row, found, err)
+		}
+		table, err := repo.GetTable(ctx, LegacyDatabase, "users")
+		if err != nil || len(table.Columns) != 3 {
+			t.Fatalf("open %d: table = %+v %v", i, table, err)
+		}
+		if v, _, _ := repo.Get("stray"); string(v) != "x" {
+			t.Fatalf("open %d: key that isn't a row = %q, want it kept", i, v)
+		}
+		if _, found, _ := repo.Get("users:999"); found {
+			t.Fatalf("open %d: legacy key still there", i)
+		}
+		repo.Close()
+	}
+}
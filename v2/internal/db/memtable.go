@@ -1,47 +1,109 @@
 package db
 
-
 import (
+	"math"
 	"sync"
 )
 
+// Entry is the latest version of a key as it moves MemTable -> SSTable -> Compaction.
+// A Tombstone marks a deleted key: it has no value, but it must still be stored
+// so it can mask older versions of the key living in older SSTables.
+// Seq is the global sequence number of the write: of two versions of a key, the higher Seq wins.
+type Entry struct {
+	Value     []byte
+	Tombstone bool
+	Seq       uint64
+}
+
+// tombstoneLen is written in place of the value length (WAL and SSTable records) for a delete.
+// A real value can never have a negative length, so old files stay readable.
+const tombstoneLen int32 = -1
+
+// MemTable is the sorted in-memory buffer in front of the SSTables, backed by a skiplist.
+// mu serializes writers; readers walk the list lock-free (see skiplist.go).
+// Once frozen (LSMRepository.imm) a MemTable is never written again.
 type MemTable struct {
-	data map[string][]byte
-	mu sync.RWMutex
+	list *skipList
+	mu   sync.RWMutex
 	size int
-}
 
+	// Sequence numbers of the first and last batch applied; the SSTable it is flushed to inherits the range.
+	smallestSeq uint64
+	largestSeq  uint64
+}
 
 func NewMemTable() *MemTable {
 	return &MemTable{
-		data: make(map[string][]byte),
+		list: newSkipList(),
 		size: 0,
 	}
 }
 
-
-func (m *MemTable) Put(key string, value []byte){
+// apply inserts every operation of a batch under a single lock acquisition.
+// The ops get the sequence numbers b.seq, b.seq+1, ... in order, so within a batch the last write to a key wins.
+func (m *MemTable) apply(b *WriteBatch) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.data[key] = value
-	m.size += len(key) + len(value)
+	for i, op := range b.ops {
+		entry := op.entry
+		entry.Seq = b.seq + uint64(i)
+		m.list.Put(op.key, entry)
+	}
+	m.size += b.size
+	if m.smallestSeq == 0 || b.seq < m.smallestSeq {
+		m.smallestSeq = b.seq
+	}
+	m.largestSeq = max(m.largestSeq, b.lastSeq())
 }
 
+// stage inserts every operation of a batch with the same sequence number seq, so a later
+// op on a key replaces an earlier one. Used for a transaction's private MemTable, which is
+// never flushed: the batch gets its real numbers when it commits.
+func (m *MemTable) stage(b *WriteBatch, seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	for _, op := range b.ops {
+		entry := op.entry
+		entry.Seq = seq
+		m.list.Put(op.key, entry)
+	}
+	m.size += b.size
+}
 
-func (m *MemTable) Get(key string) ([]byte, bool){
+// seqRange returns the smallest and largest sequence number applied to the MemTable.
+func (m *MemTable) seqRange() (uint64, uint64) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-
-	value, exists := m.data[key]
-	if exists {
-		return value, true
-	}
-	return nil, false
+	return m.smallestSeq, m.largestSeq
 }
 
+// Get returns the newest version of key; found is true for tombstones too, so callers stop searching older tables.
+func (m *MemTable) Get(key string) (Entry, bool) {
+	return m.list.Get(key, math.MaxUint64)
+}
 
+// getAt returns the newest version of key visible at sequence number seq.
+func (m *MemTable) getAt(key string, seq uint64) (Entry, bool) {
+	return m.list.Get(key, seq)
+}
 
+// Size is the approximate memory used by keys and values, which drives the flush threshold.
+func (m *MemTable) Size() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
 
+// Len is the number of entries: every version of every key, tombstones included.
+func (m *MemTable) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.list.length
+}
 
+// NewIterator returns an iterator over the MemTable in key order. Call Seek or SeekToFirst before use.
+func (m *MemTable) NewIterator() *skipListIterator {
+	return m.list.NewIterator()
+}
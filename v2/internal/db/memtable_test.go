@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// applyOne writes one put (or, with a nil value, a delete) to m as batch number seq.
+func applyOne(m *MemTable, seq uint64, key string, value []byte) {
+	b := NewWriteBatch()
+	if value == nil {
+		b.Delete(key)
+	} else {
+		b.Put(key, value)
+	}
+	b.seq = seq
+	m.apply(b)
+}
+
+func TestMemTableOrderedIteration(t *testing.T) {
+	m := NewMemTable()
+	want := make(map[string]string)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("k%04d", rnd.Intn(500))
+		v := fmt.Sprintf("v%d", i)
+		applyOne(m, uint64(i+1), k, []byte(v))
+		want[k] = v
+	}
+	applyOne(m, 2001, "k0000", nil)
+	want["k0000"] = "<tombstone>"
+
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Every version is kept
+	if m.Len() != 2001 {
+		t.Fatalf("Len = %d, want 2001", m.Len())
+	}
+
+	it := m.NewIterator()
+	i := 0
+	for it.SeekToFirst(); it.Valid(); {
+		// The newest version of each key comes first, older ones after it
+		got := string(it.Entry().Value)
+		if it.Entry().Tombstone {
+			got = "<tombstone>"
+		}
+		if it.Key() != keys[i] || got != want[keys[i]] {
+			t.Fatalf("position %d: got %s=%s, want %s=%s", i, it.Key(), got, keys[i], want[keys[i]])
+		}
+		key, seq := it.Key(), it.Entry().Seq
+		for it.Next(); it.Valid() && it.Key() == key; it.Next() {
+			if it.Entry().Seq >= seq {
+				t.Fatalf("%s: version %d after %d", key, it.Entry().Seq, seq)
+			}
+			seq = it.Entry().Seq
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatalf("iterated %d keys, want %d", i, len(keys))
+	}
+
+	// Seek lands on the first key >= target, even when the target itself is missing
+	it.Seek("k0250x")
+	idx := sort.SearchStrings(keys, "k0250x")
+	if !it.Valid() || it.Key() != keys[idx] {
+		t.Fatalf("Seek landed on the wrong key")
+	}
+	it.Seek("zzz")
+	if it.Valid() {
+		t.Fatalf("Seek past the end should be invalid, got %s", it.Key())
+	}
+}
+
+// Run with -race: readers walk the skiplist without locks while a writer inserts.
+func TestMemTableConcurrentReaders(t *testing.T) {
+	m := NewMemTable()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5000; i++ {
+			applyOne(m, uint64(i+1), fmt.Sprintf("key-%05d", i), []byte("v"))
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				prev := ""
+				it := m.NewIterator()
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					if it.Key() <= prev {
+						t.Errorf("out of order: %s after %s", it.Key(), prev)
+						return
+					}
+					prev = it.Key()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"chill-db/internal/domain"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// LegacyDatabase is the database that rows written before databases existed are moved into.
+const LegacyDatabase = "default"
+
+// migrateLegacyKeys moves the data of a directory written before databases existed into the
+// catalog's key layout. Back then a row lived at table:pk; it becomes
+// r:<LegacyDatabase>:<table>:<pk>, and every table gets a catalog entry with one string
+// column per field of its widest row (col1 is the primary key). Keys that don't look like
+// a row are kept as they are rather than lost.
+//
+// It runs once, on open, before anything else can read or write. It rewrites the whole tree
+// like a compaction would: one new table replaces all the old ones in a single MANIFEST edit,
+// which also clears the MANIFEST's legacy flag. A crash before that edit leaves the old
+// tables live and the flag set, so the next open simply starts over.
+func (r *LSMRepository) migrateLegacyKeys() error {
+	mems, tables, seq := r.current()
+	it, err := r.iteratorOver(mems, tables, "", "", seq, nil)
+	if err != nil {
+		return err
+	}
+	it.Seek("")
+
+	b := NewWriteBatch()
+	widths := make(map[string]int) // table -> fields in its widest row
+	var kept int
+	for ; it.Valid(); it.Next() {
+		tableName, pk, ok := strings.Cut(it.Key(), ":")
+		var row domain.Row
+		if !ok || tableName == "" || json.Unmarshal(it.Value(), &row) != nil {
+			b.Put(it.Key(), it.Value())
+			kept++
+			continue
+		}
+		b.Put(rowKey(LegacyDatabase, tableName, pk), it.Value())
+		widths[tableName] = max(widths[tableName], len(row))
+	}
+	if err := it.Err(); err != nil {
+		it.Close()
+		return err
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	if len(widths) > 0 {
+		b.Put(dbKey(LegacyDatabase), []byte(LegacyDatabase))
+	}
+	for tableName, width := range widths {
+		meta := domain.TableMetaData{Name: tableName}
+		for i := 1; i <= width; i++ {
+			meta.Columns = append(meta.Columns, domain.ColumnDefinition{Name: fmt.Sprintf("col%d", i), Type: "string"})
+		}
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		b.Put(tableKey(LegacyDatabase, tableName), data)
+	}
+
+	edit := versionEdit{KeysMigrated: true}
+	var output *SSTable
+	if b.Len() > 0 {
+		// The new versions sort after every old one, not that anything older survives the edit
+		mem := NewMemTable()
+		r.applyRecovered(mem, b)
+		if output, err = r.writeMemTable(mem); err != nil {
+			return err
+		}
+		edit.Added = []tableInfo{output.info()}
+		edit.LastSeq = output.LargestSeq
+	}
+	edit.NextFile = r.nextFile.Load()
+
+	r.mu.Lock()
+	old := r.sstables
+	r.mu.Unlock()
+	for _, t := range old {
+		edit.Deleted = append(edit.Deleted, filepath.Base(t.Filename))
+	}
+
+	// Commit point, as for a compaction: the output's directory entry must be durable first
+	if err := syncDir(r.storageDir); err != nil {
+		if output != nil {
+			output.discard()
+		}
+		return err
+	}
+	if err := r.manifest.logEdit(edit); err != nil {
+		if output != nil {
+			output.discard()
+		}
+		return err
+	}
+
+	r.mu.Lock()
+	r.sstables = nil
+	if output != nil {
+		output.ref()
+		r.sstables = append(r.sstables, output)
+	}
+	r.tablesChanged()
+	r.mu.Unlock()
+	r.visibleSeq.Store(r.lastSeq.Load())
+	for _, t := range old {
+		t.unref()
+	}
+
+	fmt.Printf("🔄 Moved %d tables of legacy rows into database '%s' (%d other keys kept as is).\n", len(widths), LegacyDatabase, kept)
+	return nil
+}
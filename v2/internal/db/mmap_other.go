@@ -0,0 +1,14 @@
+//go:build !unix
+
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("mmap: not supported on this platform")
+}
+
+func munmap(data []byte) error { return nil }
@@ -0,0 +1,30 @@
+//go:build unix
+
+package db
+
+import (
+	"errors"
+	"math"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the whole of f read-only. Only on 64-bit platforms: there, address space is
+// plentiful enough to map every table; on 32-bit ones a few big tables would exhaust it.
+func mmapFile(f *os.File) ([]byte, error) {
+	if math.MaxInt == math.MaxInt32 {
+		return nil, errors.New("mmap: not on a 32-bit platform")
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, errors.New("mmap: empty file")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
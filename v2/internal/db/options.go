@@ -0,0 +1,166 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Options tunes an LSMRepository. Zero values fall back to the defaults, so
+// Options{MemTableSize: 1 << 20} only changes what it mentions.
+type Options struct {
+	// MemTableSize is how many bytes (keys + values) the active MemTable may hold before it is
+	// frozen and flushed to an SSTable in the background while a fresh one takes the writes.
+	MemTableSize int
+
+	// SyncMode picks the WAL durability policy (see SyncAlways, SyncInterval, SyncNone).
+	// Whatever the mode, concurrent writers are group-committed.
+	SyncMode SyncMode
+	// SyncInterval is how often SyncInterval mode fsyncs the WAL.
+	SyncInterval time.Duration
+
+	// L0CompactionTrigger is how many level-0 tables (flushed MemTables, whose key ranges
+	// overlap) may pile up before they are compacted into level 1.
+	L0CompactionTrigger int
+	// L0SlowdownTrigger and L0StopTrigger throttle writers while compaction falls behind:
+	// from L0SlowdownTrigger level-0 sorted runs (tables, unless size-tiered compaction
+	// merged some into one run) on every write is delayed by 1ms, at
+	// L0StopTrigger writes wait for a compaction. Only applies with a compaction worker running.
+	L0SlowdownTrigger int
+	L0StopTrigger     int
+	// LevelSizes are the target sizes in bytes of level 1, 2, ...; there are len(LevelSizes)
+	// levels below level 0. A level over its target gets one table at a time compacted into
+	// the next one. The last level has nowhere to go, so its target is never enforced.
+	LevelSizes []int64
+	// TargetFileSize is roughly how big compaction output files get: the output is cut into a
+	// new table once this many bytes of records are written (never between versions of one key).
+	TargetFileSize int64
+	// BlockSize is roughly how many bytes of entries go in one SSTable data block, the unit a
+	// lookup reads from disk. Bigger blocks mean a smaller index but more bytes read per Get.
+	BlockSize int
+	// Compression is the codec for data blocks: CompressionSnappy (the default),
+	// CompressionNone or CompressionFlate. Tables written with another codec stay readable.
+	Compression Compression
+	// BloomFPRate is the false-positive rate new tables' Bloom filters are sized for: the share
+	// of lookups for keys a table doesn't hold that still read it. 0.01 (the default) costs
+	// about 10 bits per key; every halving adds about 1.4 bits.
+	BloomFPRate float64
+	// PrefixExtractor, if set, adds the prefix of every key to the Bloom filters of new tables,
+	// so scans within one prefix skip the tables that hold none of its keys. TablePrefix{}
+	// does it for table scans. Tables written without it (or with another) are always read.
+	PrefixExtractor PrefixExtractor
+	// ParanoidChecks reads every SSTable in full when the repository opens (refusing to open
+	// if one is damaged) and reads every new table back before publishing it. Without it only
+	// the blocks a read touches are checked, and a damaged table fails just the reads that reach it.
+	ParanoidChecks bool
+	// BlockCacheSize is how many bytes of decoded data blocks the repository keeps in memory,
+	// shared by all its tables. A Get whose block is cached reads nothing from disk. Negative disables it.
+	BlockCacheSize int64
+	// MaxOpenFiles is how many table files may be open at once. The least recently read ones
+	// are closed beyond it and reopened when read again.
+	MaxOpenFiles int
+	// MmapReads maps every open table file into memory and serves reads from the mapping
+	// instead of a pread per block. Worth it for read-heavy workloads whose tables fit the page
+	// cache. 64-bit Unix only; where mapping a file fails its reads fall back to pread.
+	MmapReads bool
+	// Compaction picks what the background worker compacts: &LeveledCompaction{} (the
+	// default) or &SizeTieredCompaction{} for fewer rewrites on write-heavy workloads.
+	Compaction CompactionStrategy
+}
+
+const (
+	DefaultMemTableSize        = 4 << 20 // 4 MiB
+	DefaultSyncInterval        = 100 * time.Millisecond
+	DefaultL0CompactionTrigger = 4
+	DefaultL0SlowdownTrigger   = 8
+	DefaultL0StopTrigger       = 12
+	DefaultTargetFileSize      = 2 << 20 // 2 MiB
+	DefaultBlockSize           = 4 << 10 // 4 KiB
+	DefaultBlockCacheSize      = 8 << 20 // 8 MiB
+	DefaultBloomFPRate         = 0.01
+	DefaultMaxOpenFiles        = 500
+)
+
+// DefaultLevelSizes: 10 MiB for level 1, each level ten times the one above, 6 levels in all.
+var DefaultLevelSizes = []int64{10 << 20, 100 << 20, 1 << 30, 10 << 30, 100 << 30, 1000 << 30}
+
+func DefaultOptions() Options {
+	return Options{
+		MemTableSize:        DefaultMemTableSize,
+		SyncMode:            SyncAlways,
+		SyncInterval:        DefaultSyncInterval,
+		L0CompactionTrigger: DefaultL0CompactionTrigger,
+		L0SlowdownTrigger:   DefaultL0SlowdownTrigger,
+		L0StopTrigger:       DefaultL0StopTrigger,
+		LevelSizes:          DefaultLevelSizes,
+		TargetFileSize:      DefaultTargetFileSize,
+		BlockSize:           DefaultBlockSize,
+		BlockCacheSize:      DefaultBlockCacheSize,
+		BloomFPRate:         DefaultBloomFPRate,
+		MaxOpenFiles:        DefaultMaxOpenFiles,
+		Compaction:          &LeveledCompaction{},
+	}
+}
+
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.MemTableSize <= 0 {
+		o.MemTableSize = d.MemTableSize
+	}
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = d.SyncInterval
+	}
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = d.L0CompactionTrigger
+	}
+	if o.L0SlowdownTrigger <= 0 {
+		o.L0SlowdownTrigger = max(d.L0SlowdownTrigger, o.L0CompactionTrigger)
+	}
+	if o.L0StopTrigger <= 0 {
+		o.L0StopTrigger = max(d.L0StopTrigger, o.L0SlowdownTrigger)
+	}
+	if len(o.LevelSizes) == 0 {
+		o.LevelSizes = d.LevelSizes
+	}
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = d.TargetFileSize
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = d.BlockSize
+	}
+	if o.BlockCacheSize == 0 {
+		o.BlockCacheSize = d.BlockCacheSize
+	}
+	if o.BloomFPRate <= 0 || o.BloomFPRate >= 1 {
+		o.BloomFPRate = d.BloomFPRate
+	}
+	if o.MaxOpenFiles <= 0 {
+		o.MaxOpenFiles = d.MaxOpenFiles
+	}
+	if o.Compaction == nil {
+		o.Compaction = d.Compaction
+	}
+	return o
+}
+
+// numLevels counts level 0 too.
+func (o Options) numLevels() int { return len(o.LevelSizes) + 1 }
+
+// levelTarget is the size level (>= 1) may grow to before it is compacted.
+func (o Options) levelTarget(level int) int64 { return o.LevelSizes[level-1] }
+
+// ParseSyncPolicy reads a WAL sync policy as given on a command line:
+// "always", "none", or an interval such as "50ms" (also "every 50ms").
+func ParseSyncPolicy(s string) (SyncMode, time.Duration, error) {
+	switch s = strings.TrimSpace(strings.ToLower(s)); s {
+	case "always", "":
+		return SyncAlways, 0, nil
+	case "none":
+		return SyncNone, 0, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(s, "every")))
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid sync policy %q (want always, none or an interval like 100ms)", s)
+	}
+	return SyncInterval, d, nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrefixExtractor maps keys to prefixes that go into every table's Bloom filter next to the
+// keys themselves. A scan whose range lies within one prefix then leaves out the tables whose
+// filter says they hold no key with it, without reading them.
+//
+// Prefix(key) must return a prefix of key, and every key starting with that prefix must map
+// to the same one: that is what lets the prefix of a scan's start key stand for every key in
+// the scan.
+type PrefixExtractor interface {
+	// Name identifies the extractor. It is recorded in every filter, so a filter built by a
+	// different extractor (or none) is never asked about prefixes.
+	Name() string
+	// Prefix returns the prefix of key, or ok = false if key has none (it is then only
+	// filtered as a whole key).
+	Prefix(key string) (prefix string, ok bool)
+}
+
+// TablePrefix extracts "r:<db>:<table>:" from row keys, plus the first PKLen bytes of the
+// primary key: with PKLen 0 a full table scan skips the SSTables without a row of the table,
+// with PKLen 3 a scan for primary keys starting with "abc" skips those without one. A scan
+// for a shorter primary key prefix than PKLen can't use the filters. Catalog keys (databases,
+// table definitions) have no prefix.
+type TablePrefix struct {
+	PKLen int
+}
+
+func (p TablePrefix) Name() string {
+	return fmt.Sprintf("table+%d", p.PKLen)
+}
+
+func (p TablePrefix) Prefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, rowKeyPrefix) {
+		return "", false
+	}
+	// Database and table names never contain ':' (see validName), primary keys may
+	end := len(rowKeyPrefix)
+	for i := 0; i < 2; i++ {
+		n := strings.IndexByte(key[end:], ':')
+		if n < 0 {
+			return "", false
+		}
+		end += n + 1
+	}
+	if len(key)-end < p.PKLen {
+		return "", false
+	}
+	return key[:end+p.PKLen], true
+}
+
+// scanPrefix is the prefix all keys in [lower, upper) share under pe, or ok = false if they
+// don't share one.
+func scanPrefix(pe PrefixExtractor, lower, upper string) (string, bool) {
+	if pe == nil {
+		return "", false
+	}
+	p, ok := pe.Prefix(lower)
+	if !ok {
+		return "", false
+	}
+	// lower starts with p, so every key in [lower, prefixEnd(p)) does too
+	if end := prefixEnd(p); upper == "" || (end != "" && upper > end) {
+		return "", false
+	}
+	return p, true
+}
+
+// ParsePrefixExtractor reads an extractor as given on a command line: "none" (nil), "table"
+// for TablePrefix{}, or "table+N" for TablePrefix{PKLen: N}.
+func ParsePrefixExtractor(s string) (PrefixExtractor, error) {
+	switch s = strings.TrimSpace(strings.ToLower(s)); s {
+	case "", "none":
+		return nil, nil
+	case "table":
+		return TablePrefix{}, nil
+	}
+	var n int
+	if _, err := fmt.Sscanf(s, "table+%d", &n); err != nil || n < 0 || s != (TablePrefix{PKLen: n}).Name() {
+		return nil, fmt.Errorf("invalid prefix extractor %q (want none, table or table+N)", s)
+	}
+	return TablePrefix{PKLen: n}, nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTablePrefix(t *testing.T) {
+	for _, c := range []struct {
+		pkLen int
+		key   string
+		want  string // "" = no prefix
+	}{
+		{0, "r:shop:users:42", "r:shop:users:"},
+		{0, "r:shop:users:", "r:shop:users:"},
+		{0, "r:shop:users", ""},
+		{0, "t:shop:users", ""},
+		{2, "r:shop:users:abc", "r:shop:users:ab"},
+		{2, "r:shop:users:a:b", "r:shop:users:a:"}, // primary keys may contain ':'
+		{2, "r:shop:users:a", ""},
+	} {
+		got, ok := TablePrefix{PKLen: c.pkLen}.Prefix(c.key)
+		if ok != (c.want != "") || got != c.want {
+			t.Errorf("TablePrefix{%d}.Prefix(%q) = %q, %v; want %q", c.pkLen, c.key, got, ok, c.want)
+		}
+	}
+	if pe, err := ParsePrefixExtractor("table+3"); err != nil || pe != (TablePrefix{PKLen: 3}) {
+		t.Fatalf("ParsePrefixExtractor(table+3) = %v, %v", pe, err)
+	}
+	if _, err := ParsePrefixExtractor("table+x"); err == nil {
+		t.Fatal("parsed table+x")
+	}
+}
+
+// Two tables, each holding the rows of one SQL table: a scan of one leaves the other out.
+// Both also hold a row of a third table past the others, so their key ranges overlap and
+// only the prefixes tell them apart.
+func TestPrefixScanSkipsTables(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepositoryWithOptions(dir, Options{PrefixExtractor: TablePrefix{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		repo.put(fmt.Sprintf("r:shop:users:%03d", i), []byte("user"))
+	}
+	repo.put("r:shop:zzz:1", []byte("z"))
+	repo.Flush()
+	for i := 0; i < 100; i++ {
+		repo.put(fmt.Sprintf("r:shop:orders:%03d", i), []byte("order"))
+	}
+	repo.put("r:shop:zzz:2", []byte("z"))
+	repo.Flush()
+
+	count := func(prefix string) int {
+		t.Helper()
+		it, err := repo.Scan(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		n := 0
+		for ; it.Valid(); it.Next() {
+			n++
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		return n
+	}
+	skips := func() (total int64) {
+		for _, s := range repo.FilterStats() {
+			total += s.PrefixSkips
+		}
+		return total
+	}
+
+	if n := count("r:shop:users:"); n != 100 || skips() != 1 {
+		t.Fatalf("users scan: %d rows, %d tables skipped; want 100 and 1", n, skips())
+	}
+	// The users table's range starts past "products": only the orders table is asked
+	if n := count("r:shop:products:"); n != 0 || skips() != 2 {
+		t.Fatalf("scan of an absent table: %d rows, %d skips so far; want 0 and 2", n, skips())
+	}
+	// A scan that isn't within one prefix reads every table
+	if n := count("r:shop:"); n != 202 || skips() != 2 {
+		t.Fatalf("database scan: %d rows, %d skips so far; want 202 and 2", n, skips())
+	}
+	repo.Close()
+
+	// With another extractor the filters are never asked about prefixes: nothing is skipped
+	repo, err = NewLSMRepositoryWithOptions(dir, Options{PrefixExtractor: TablePrefix{PKLen: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if n := count("r:shop:users:01"); n != 10 || skips() != 0 {
+		t.Fatalf("scan under another extractor: %d rows, %d skips; want 10 and 0", n, skips())
+	}
+}
@@ -14,7 +14,18 @@ type Repository interface {
 
 	InsertRow(ctx context.Context, dbName, tableName string, row domain.Row) error
 
+	// InsertRows inserts all rows or none of them.
+	InsertRows(ctx context.Context, dbName, tableName string, rows []domain.Row) error
+
 	Query(ctx context.Context, dbName, tableName string) ([]domain.Row, error)
 
 	DropDatabase(ctx context.Context, dbName string) error
 }
+
+// TxRepository is a Repository that supports transactions (the LSM engine).
+type TxRepository interface {
+	Repository
+
+	// Begin starts an optimistic transaction; see Txn.
+	Begin() *Txn
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// A skiplist is a sorted linked list with "express lanes": every node is on level 0,
+// about 1/4 of them are also on level 1, 1/16 on level 2, and so on. A search starts on
+// the highest lane and drops down a level whenever the next node would overshoot,
+// which gives O(log n) Put/Get while keeping keys in order for free (no sort on flush).
+//
+// Every version of a key gets its own node. Nodes are ordered by key, then by sequence
+// number DESCENDING, so the newest version of a key comes first and a reader at an older
+// snapshot walks forward to the first version it is allowed to see.
+//
+// Concurrency: one writer at a time (MemTable.mu), any number of readers without locks.
+// A new node is fully built before it is linked in with an atomic store, so a reader
+// either sees the finished node or doesn't see it at all.
+
+const (
+	skipListMaxHeight = 12 // 4^12 ≈ 16M keys before the lanes stop helping
+	skipListBranching = 4  // 1 in 4 nodes is promoted to the next level
+)
+
+type skipNode struct {
+	key   string
+	seq   uint64
+	entry atomic.Pointer[Entry] // swapped atomically when the same (key, seq) is written twice
+	next  []atomic.Pointer[skipNode]
+}
+
+// before reports whether node n sorts before (key, seq).
+func (n *skipNode) before(key string, seq uint64) bool {
+	return n.key < key || (n.key == key && n.seq > seq)
+}
+
+type skipList struct {
+	head   *skipNode
+	height atomic.Int32
+	length int // number of nodes (versions), only touched by the writer
+	rnd    *rand.Rand
+}
+
+func newSkipList() *skipList {
+	s := &skipList{
+		head: &skipNode{next: make([]atomic.Pointer[skipNode], skipListMaxHeight)},
+		rnd:  rand.New(rand.NewSource(0xC0FFEE)),
+	}
+	s.height.Store(1)
+	return s
+}
+
+func (s *skipList) randomHeight() int {
+	h := 1
+	for h < skipListMaxHeight && s.rnd.Intn(skipListBranching) == 0 {
+		h++
+	}
+	return h
+}
+
+// findGreaterOrEqual returns the first node at or after (key, seq) (nil if none).
+// If prev is non-nil it is filled with the last node before that position on every level.
+func (s *skipList) findGreaterOrEqual(key string, seq uint64, prev []*skipNode) *skipNode {
+	x := s.head
+	level := int(s.height.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil && next.before(key, seq) {
+			x = next // keep moving along this lane
+			continue
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+		level-- // overshoot: drop to a slower lane
+	}
+}
+
+// Put adds a version of key at entry.Seq. Writing the same (key, seq) again replaces it.
+// Returns true if a node was added.
+func (s *skipList) Put(key string, entry Entry) bool {
+	var prev [skipListMaxHeight]*skipNode
+	x := s.findGreaterOrEqual(key, entry.Seq, prev[:])
+	if x != nil && x.key == key && x.seq == entry.Seq {
+		x.entry.Store(&entry)
+		return false
+	}
+
+	h := s.randomHeight()
+	if cur := int(s.height.Load()); h > cur {
+		for i := cur; i < h; i++ {
+			prev[i] = s.head
+		}
+		// Readers that see the new height before the node is linked just find nil
+		// on the new levels and drop down, so this order is safe.
+		s.height.Store(int32(h))
+	}
+
+	n := &skipNode{key: key, seq: entry.Seq, next: make([]atomic.Pointer[skipNode], h)}
+	n.entry.Store(&entry)
+	for i := 0; i < h; i++ {
+		n.next[i].Store(prev[i].next[i].Load()) // link the new node first...
+		prev[i].next[i].Store(n)                // ...then publish it
+	}
+	s.length++
+	return true
+}
+
+// Get returns the newest version of key with a sequence number <= seq.
+func (s *skipList) Get(key string, seq uint64) (Entry, bool) {
+	x := s.findGreaterOrEqual(key, seq, nil)
+	if x != nil && x.key == key {
+		return *x.entry.Load(), true
+	}
+	return Entry{}, false
+}
+
+// skipListIterator walks the list in key order. It is safe to use while the writer keeps
+// inserting: it will observe some, all or none of the keys added after it was created.
+type skipListIterator struct {
+	list *skipList
+	node *skipNode
+}
+
+func (s *skipList) NewIterator() *skipListIterator {
+	return &skipListIterator{list: s}
+}
+
+// Seek positions the iterator at the newest version of the first key >= key.
+func (it *skipListIterator) Seek(key string) {
+	it.node = it.list.findGreaterOrEqual(key, math.MaxUint64, nil)
+}
+
+func (it *skipListIterator) SeekToFirst() {
+	it.node = it.list.head.next[0].Load()
+}
+
+func (it *skipListIterator) Valid() bool { return it.node != nil }
+
+func (it *skipListIterator) Next() { it.node = it.node.next[0].Load() }
+
+func (it *skipListIterator) Key() string { return it.node.key }
+
+func (it *skipListIterator) Entry() Entry { return *it.node.entry.Load() }
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A small implementation of the Snappy block format (github.com/google/snappy, format_description.txt),
+// so the module keeps no dependencies. The encoder is the simple greedy kind: a hash table of
+// 4-byte sequences, no skipping heuristics. SSTable blocks are a few KiB, so that is plenty.
+//
+//	stream  = [uncompressed length uvarint] element...
+//	element = literal: tag 00, length-1 in the upper 6 bits (60..63: 1..4 length bytes follow), then the bytes
+//	          copy:    tag 01 (length 4..11, 11-bit offset), 10 (length 1..64, 2-byte offset) or 11 (4-byte offset)
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+const (
+	snappyTableBits = 12
+	snappyMaxOffset = 1<<16 - 1
+	// Decoded blocks are a few KiB; a length beyond this is corruption, not data
+	maxDecodedBlockLen = 256 << 20
+)
+
+// snappyEncoder keeps its hash table between blocks.
+type snappyEncoder struct {
+	table [1 << snappyTableBits]int32
+}
+
+func snappyHash(u uint32) uint32 { return (u * 0x1e35a7bd) >> (32 - snappyTableBits) }
+
+// encode appends the compressed form of src to dst.
+func (e *snappyEncoder) encode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	clear(e.table[:])
+
+	lit := 0 // start of the literal not emitted yet
+	for s := 1; s+4 <= len(src); {
+		cur := binary.LittleEndian.Uint32(src[s:])
+		h := snappyHash(cur)
+		cand := int(e.table[h])
+		e.table[h] = int32(s)
+		if s-cand > snappyMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			s++
+			continue
+		}
+		n := 4
+		for s+n < len(src) && src[cand+n] == src[s+n] {
+			n++
+		}
+		dst = emitLiteral(dst, src[lit:s])
+		dst = emitCopy(dst, s-cand, n)
+		s += n
+		lit = s
+	}
+	return emitLiteral(dst, src[lit:])
+}
+
+func emitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func emitCopy(dst []byte, offset, length int) []byte {
+	// A 2-byte-offset copy holds at most 64 bytes. Leave at least 4 for the last one.
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length < 12 && offset < 2048 {
+		return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+	}
+	return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+}
+
+// snappyDecode decompresses a whole stream.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > maxDecodedBlockLen {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, n)
+	for s := k; s < len(src); {
+		tag := src[s]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[s+i])
+				}
+				s += extra
+			}
+			length++
+			if length > len(src)-s || uint64(len(dst)+length) > n {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case 1:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+		case 2:
+			if s+3 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 3:
+			if s+5 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errSnappyCorrupt
+		}
+		// Byte by byte: the copy may overlap what it appends (offset < length repeats a pattern)
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
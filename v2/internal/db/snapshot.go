@@ -0,0 +1,96 @@
+package db
+
+import (
+	"sync/atomic"
+)
+
+// Snapshot is a read-only view of the database frozen at the moment it was taken: its Get
+// and iterators see exactly the writes with a sequence number <= Seq(), no matter what is
+// written, flushed or compacted afterwards.
+//
+//	snap := repo.NewSnapshot()
+//	defer snap.Release()
+//	v, found, err := snap.Get("r:shop:users:1")
+//
+// While a snapshot is live, compaction keeps the old versions it can see (see retainVersions),
+// so release it as soon as you are done.
+type Snapshot struct {
+	repo     *LSMRepository
+	seq      uint64
+	released atomic.Bool
+}
+
+// NewSnapshot pins the current state of the database.
+func (r *LSMRepository) NewSnapshot() *Snapshot {
+	r.snapMu.Lock()
+	defer r.snapMu.Unlock()
+
+	// Taken under snapMu, so a compaction computing smallestSnapshot either sees this snapshot
+	// or ran before it existed (and then only dropped versions older than what it can see).
+	seq := r.visibleSeq.Load()
+	r.snapshots[seq]++
+	return &Snapshot{repo: r, seq: seq}
+}
+
+// Seq is the sequence number of the last write the snapshot sees.
+func (s *Snapshot) Seq() uint64 { return s.seq }
+
+// Get is a point lookup as of the snapshot.
+func (s *Snapshot) Get(key string) ([]byte, bool, error) {
+	return s.repo.getAt(key, s.seq)
+}
+
+// NewIterator returns an unpositioned iterator over the whole key space as of the snapshot; call Seek first.
+func (s *Snapshot) NewIterator() (Iterator, error) {
+	return s.repo.newIterator("", "", s.seq)
+}
+
+// Range returns an iterator over keys in [start, end) as of the snapshot, positioned on the first one.
+func (s *Snapshot) Range(start, end string) (Iterator, error) {
+	return s.repo.rangeAt(start, end, s.seq)
+}
+
+// Scan returns an iterator over every key starting with prefix as of the snapshot.
+func (s *Snapshot) Scan(prefix string) (Iterator, error) {
+	return s.repo.rangeAt(prefix, prefixEnd(prefix), s.seq)
+}
+
+// Release lets compaction drop the versions only this snapshot needed. Calling it twice is harmless.
+func (s *Snapshot) Release() {
+	if s.released.Swap(true) {
+		return
+	}
+	r := s.repo
+	r.snapMu.Lock()
+	defer r.snapMu.Unlock()
+	if r.snapshots[s.seq]--; r.snapshots[s.seq] == 0 {
+		delete(r.snapshots, s.seq)
+	}
+}
+
+// smallestSnapshot is the oldest point in time any reader can still ask for: the oldest live
+// snapshot, or the latest visible write if there is none.
+func (r *LSMRepository) smallestSnapshot() uint64 {
+	r.snapMu.Lock()
+	defer r.snapMu.Unlock()
+
+	smallest := r.visibleSeq.Load()
+	for seq := range r.snapshots {
+		smallest = min(smallest, seq)
+	}
+	return smallest
+}
+
+// publish makes a written batch visible to readers. Batches can finish their WAL append and
+// MemTable insert out of order, but visibleSeq must never move past a write that isn't in
+// the MemTable yet, or a snapshot taken now would see that write appear later. So each
+// batch waits for the batches numbered before it.
+func (r *LSMRepository) publish(b *WriteBatch) {
+	r.pubMu.Lock()
+	defer r.pubMu.Unlock()
+	for r.visibleSeq.Load() != b.seq-1 {
+		r.pubCond.Wait()
+	}
+	r.visibleSeq.Store(b.lastSeq())
+	r.pubCond.Broadcast()
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotSurvivesFlushAndCompaction(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	repo.put("a", []byte("1"))
+	repo.put("b", []byte("1"))
+	snap := repo.NewSnapshot()
+
+	repo.put("a", []byte("2"))
+	repo.Delete("b")
+	repo.put("c", []byte("2"))
+
+	check := func(stage string) {
+		t.Helper()
+		if v, found, _ := snap.Get("a"); !found || string(v) != "1" {
+			t.Fatalf("%s: snapshot Get(a) = %q, %v; want 1", stage, v, found)
+		}
+		if v, found, _ := snap.Get("b"); !found || string(v) != "1" {
+			t.Fatalf("%s: snapshot Get(b) = %q, %v; want 1", stage, v, found)
+		}
+		got, err := drain(snap.Scan(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"a=1", "b=1"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: snapshot scan = %v, want %v", stage, got, want)
+		}
+		// The live view moved on
+		if got, _ := drain(repo.Scan("")); !reflect.DeepEqual(got, []string{"a=2", "c=2"}) {
+			t.Fatalf("%s: live scan = %v", stage, got)
+		}
+	}
+
+	check("memtable")
+	repo.Flush()
+	check("flushed")
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted")
+
+	// Once released, the next compaction is free to drop the old versions. The new key falls
+	// inside the compacted table's key range, so that table is merged again.
+	snap.Release()
+	snap.Release()
+	repo.put("ab", []byte("3"))
+	repo.Flush()
+	if err := repo.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := repo.sstables[0].scanVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions["a"]) != 1 || versions["b"] != nil {
+		t.Fatalf("old versions kept after release: a=%v b=%v", versions["a"], versions["b"])
+	}
+}
+
+func TestRetainVersions(t *testing.T) {
+	seqs := func(versions []Entry) []uint64 {
+		var out []uint64
+		for _, v := range versions {
+			out = append(out, v.Seq)
+		}
+		return out
+	}
+	cases := []struct {
+		name     string
+		versions []Entry
+		smallest uint64
+		want     []uint64
+	}{
+		{"no snapshots", []Entry{{Seq: 9}, {Seq: 5}, {Seq: 2}}, 10, []uint64{9}},
+		{"snapshot between versions", []Entry{{Seq: 9}, {Seq: 5}, {Seq: 2}}, 6, []uint64{9, 5}},
+		{"snapshot before all", []Entry{{Seq: 9}, {Seq: 5}}, 1, []uint64{9, 5}},
+		{"visible tombstone", []Entry{{Seq: 9, Tombstone: true}, {Seq: 5}}, 10, nil},
+		{"tombstone after snapshot", []Entry{{Seq: 9, Tombstone: true}, {Seq: 5}}, 6, []uint64{9, 5}},
+	}
+	for _, c := range cases {
+		versions := append([]Entry(nil), c.versions...)
+		if got := seqs(retainVersions(versions, c.smallest, true)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: kept %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// Run with -race: writers move two keys in lockstep with one batch each, so any snapshot
+// that sees them differ saw half of a batch or a write that wasn't published in order.
+func TestSnapshotConsistentUnderConcurrentWrites(t *testing.T) {
+	repo, err := NewLSMRepositoryWithOptions(t.TempDir(), Options{MemTableSize: 8 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				v := []byte(fmt.Sprintf("%d-%d", w, i))
+				b := NewWriteBatch()
+				b.Put("x", v)
+				b.Put("y", v)
+				if err := repo.Write(b); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		snap := repo.NewSnapshot()
+		x, _, err1 := snap.Get("x")
+		y, _, err2 := snap.Get("y")
+		snap.Release()
+		if err1 != nil || err2 != nil {
+			t.Fatal(err1, err2)
+		}
+		if string(x) != string(y) {
+			t.Fatalf("snapshot at %d saw x=%s y=%s", snap.Seq(), x, y)
+		}
+	}
+}
+
+// Plain reads during a compaction that already chose what to drop (smallestSnapshot) but
+// hasn't installed its outputs: they see the version live at their point in time, and so
+// does an iterator opened then and read after the install.
+func TestReadsDuringCompactionInstall(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	for _, v := range []string{"v1", "v2"} {
+		repo.put("k", []byte(v))
+		repo.put("other-"+v, []byte("x"))
+		repo.Flush()
+	}
+
+	held, release := make(chan struct{}), make(chan struct{})
+	repo.beforeInstall = func() {
+		close(held)
+		<-release
+	}
+	done := make(chan error)
+	go func() { done <- repo.Compact() }()
+	<-held
+
+	if v, found, err := repo.Get("k"); err != nil || !found || string(v) != "v2" {
+		t.Fatalf("Get during the compaction = %q, %v, %v", v, found, err)
+	}
+	it, err := repo.Range("k", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.sstables) != 1 {
+		t.Fatalf("%d tables after the compaction", len(repo.sstables))
+	}
+	if !it.Valid() || it.Key() != "k" || string(it.Value()) != "v2" {
+		t.Fatalf("iterator opened during the compaction: valid %v, %v", it.Valid(), it.Err())
+	}
+	if v, found, err := repo.Get("k"); err != nil || !found || string(v) != "v2" {
+		t.Fatalf("Get after the compaction = %q, %v, %v", v, found, err)
+	}
+}
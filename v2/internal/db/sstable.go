@@ -1,14 +1,50 @@
 package db
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 )
 
+// Table formats. The MANIFEST remembers which one each table uses; block tables also
+// identify themselves by the magic number at the end of their footer.
+const (
+	sstFormatLegacy = 0 // flat records: [keyLen int32][valLen int32][key][value], adopted from older versions
+	sstFormatBlock  = 1 // data blocks with restart points and an index block, see block.go
+)
+
+// ErrCorruption matches every *CorruptionError: errors.Is(err, ErrCorruption).
+var ErrCorruption = errors.New("data corruption")
+
+// CorruptionError reports a table that failed a checksum or doesn't decode: bit rot, a torn
+// write, a truncated file. Reads return it instead of pretending the key isn't there.
+type CorruptionError struct {
+	File   string
+	Offset int64 // where in File the damage was found (the start of the block for block tables)
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corruption in %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool { return target == ErrCorruption }
+
+func (sst *SSTable) corruption(offset int64, format string, args ...any) error {
+	return &CorruptionError{File: sst.Filename, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
 type IndexEntry struct {
 	Key    string
 	Offset int64
@@ -18,301 +54,1051 @@ type SSTable struct {
 	Filename string
 	Filter   *BloomFilter
 	Index    []IndexEntry
+
+	// Where the table sits in the tree, as recorded in the MANIFEST
+	Level       int
+	SmallestSeq uint64
+	LargestSeq  uint64
+	SmallestKey string // first and last key in the table: compaction picks tables by key range
+	LargestKey  string
+	Size        int64 // file size in bytes, counted against the level's target
+	num         uint64
+	format      int
+	run         uint64 // level 0: number of the sorted run the table is part of, 0 if it is one on its own
+
+	// A repository's tables get their file handles from its table cache, which bounds how many
+	// are open at once, and keep decoded data blocks in its block cache. A table on its own
+	// (files == nil) opens its file once and keeps it. Reads go through ReadAt, which is safe
+	// for concurrent use.
+	files   *tableCache
+	bcache  *blockCache
+	fileMu  sync.Mutex
+	file    *tableHandle // when files == nil
+	blocks  []indexEntry // block format: the index block, one entry per data block
+	dataEnd int64        // flat format: where the records stop
+	err     error        // why the metadata didn't load: every read of the table returns it
+	entries int64        // records in the table (versions, tombstones included); 0 if unknown
+
+	// keyRange: SmallestKey and LargestKey are known (from the file, the MANIFEST or the
+	// table's own contents), so lookups and scans outside them skip the table. Without it
+	// the table is always read.
+	keyRange bool
+
+	// refs counts who is using the file: the live tree holds one reference, every read in
+	// progress holds another. Once a compaction retires the table, the last one out deletes the file.
+	refs atomic.Int32
+
+	// What the filter did for lookups of keys the table doesn't hold (see FilterStats)
+	filterNegatives      atomic.Int64
+	filterFalsePositives atomic.Int64
+	prefixSkips          atomic.Int64 // prefix scans that left the table out
+	rangeSkips           atomic.Int64 // lookups and scans outside the table's key range
 }
 
-func (sst *SSTable) LoadFilter() error {
-	f, err := os.Open(sst.Filename)
-	if err != nil {
-		return err
+// mayContainPrefix reports whether the table may hold keys with prefix (as extracted by pe).
+func (sst *SSTable) mayContainPrefix(pe PrefixExtractor, prefix string) bool {
+	if sst.Filter == nil || sst.Filter.MayContainPrefix(pe, prefix) {
+		return true
 	}
-	defer f.Close()
+	sst.prefixSkips.Add(1)
+	return false
+}
 
-	// Seek to the end to find the Filter Length
-	// The file structure is: [Data] [FilterLen(8 bytes)] [FilterData]
-	stat, _ := f.Stat()
-	fileSize := stat.Size()
+func (sst *SSTable) ref() { sst.refs.Add(1) }
 
-	if fileSize < 8 {
-		return nil // File too small to have a filter
+func (sst *SSTable) unref() {
+	if sst.refs.Add(-1) == 0 {
+		sst.closeFile()
+		if err := os.Remove(sst.Filename); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("❌ Failed to remove retired table %s: %v\n", sst.Filename, err)
+		}
 	}
-	// Seek to "End - 8 bytes"
-	// 0 = Origin (Start), 1 = Current, 2 = End
-	// Read Footer (Last 8 bytes) = Filter Length
-	if _, err := f.Seek(-8, 2); err != nil {
-		return err
+}
+
+// acquire returns an open handle on the file. release it when done.
+func (sst *SSTable) acquire() (*tableHandle, error) {
+	if sst.files != nil {
+		return sst.files.acquire(sst.num, sst.Filename)
 	}
+	sst.fileMu.Lock()
+	defer sst.fileMu.Unlock()
+	if sst.file == nil {
+		f, err := os.Open(sst.Filename)
+		if err != nil {
+			return nil, err
+		}
+		sst.file = &tableHandle{f: f}
+	}
+	return sst.file, nil
+}
 
-	var filterLen uint64
-	if err := binary.Read(f, binary.LittleEndian, &filterLen); err != nil {
-		return err
+func (sst *SSTable) release(h *tableHandle) {
+	if sst.files != nil {
+		sst.files.release(h)
 	}
+}
 
-	// Calculate Position of Filter Data
-	// File: [ ... Data ... ] [FilterData (len)] [Footer (8)]
-	// Position = FileSize - 8 - filterLen
-	offset := fileSize - 8 - int64(filterLen)
-	if offset < 0 {
-		return nil
+func (sst *SSTable) closeFile() {
+	if sst.files != nil {
+		sst.files.evict(sst.num)
 	}
+	sst.fileMu.Lock()
+	defer sst.fileMu.Unlock()
+	if sst.file != nil {
+		sst.file.f.Close()
+		sst.file = nil
+	}
+}
 
-	// Read Filter Data
-	if _, err := f.Seek(offset, 0); err != nil {
-		return err
+// discard closes and deletes a table that was written but never published.
+func (sst *SSTable) discard() {
+	sst.closeFile()
+	os.Remove(sst.Filename)
+}
+
+func (sst *SSTable) info() tableInfo {
+	return tableInfo{
+		Name:        filepath.Base(sst.Filename),
+		Num:         sst.num,
+		Level:       sst.Level,
+		SmallestSeq: sst.SmallestSeq,
+		LargestSeq:  sst.LargestSeq,
+		SmallestKey: sst.SmallestKey,
+		LargestKey:  sst.LargestKey,
+		Size:        sst.Size,
+		Format:      sst.format,
+		Run:         sst.run,
+	}
+}
+
+// SSTableInfo describes one live table, as listed by LSMRepository.Tables.
+type SSTableInfo struct {
+	Name        string // file name inside the storage dir
+	Level       int
+	Size        int64 // bytes on disk
+	Entries     int64 // records, every version and tombstone counted; 0 for flat tables
+	SmallestKey string
+	LargestKey  string
+	SmallestSeq uint64 // sequence numbers of the oldest and newest write in the table
+	LargestSeq  uint64
+}
+
+// mayContainKey is false if key is outside the table's key range.
+func (sst *SSTable) mayContainKey(key string) bool {
+	if !sst.keyRange || (key >= sst.SmallestKey && key <= sst.LargestKey) {
+		return true
+	}
+	sst.rangeSkips.Add(1)
+	return false
+}
+
+// mayOverlapRange is false if no key of the table is in [lower, upper) (an empty upper: no bound).
+func (sst *SSTable) mayOverlapRange(lower, upper string) bool {
+	if !sst.keyRange || (sst.LargestKey >= lower && (upper == "" || sst.SmallestKey < upper)) {
+		return true
 	}
+	sst.rangeSkips.Add(1)
+	return false
+}
+
+// overlaps reports whether the table may hold keys in [smallest, largest].
+func (sst *SSTable) overlaps(smallest, largest string) bool {
+	return sst.SmallestKey <= largest && smallest <= sst.LargestKey
+}
 
-	filterData := make([]byte, filterLen)
-	if _, err := f.Read(filterData); err != nil {
+// loadKeyRange fills in the key range and size of a table adopted without them. A block
+// table has its range in its properties block already. In a flat one the first key is the
+// first index entry; the last one is found by reading from the last index entry to the
+// end, so this never reads more than one index interval.
+func (sst *SSTable) loadKeyRange() error {
+	stat, err := os.Stat(sst.Filename)
+	if err != nil {
 		return err
 	}
+	sst.Size = stat.Size()
+	if sst.format == sstFormatBlock || len(sst.Index) == 0 {
+		return nil
+	}
 
-	sst.Filter = DecodeBloomFilter(filterData)
-	return nil
+	it := sst.newFlatIterator()
+	defer it.Close()
+	sst.SmallestKey = sst.Index[0].Key
+	for it.seekTo(sst.Index[len(sst.Index)-1].Offset); it.Valid(); it.Next() {
+		sst.LargestKey = it.Key()
+	}
+	sst.keyRange = it.Err() == nil
+	return it.Err()
 }
-func (sst *SSTable) Search(searchkey string) ([]byte, bool, error) {
+
+// releaseTables drops the references taken by LSMRepository.current.
+func releaseTables(tables []*SSTable) {
+	for _, sst := range tables {
+		sst.unref()
+	}
+}
+
+// sortTables puts tables in search order: level by level, and within level 0 (whose
+// tables overlap) the table holding the newest writes first. Deeper levels never overlap,
+// so their tables are simply in key order.
+func sortTables(tables []*SSTable) {
+	sort.Slice(tables, func(i, j int) bool {
+		a, b := tables[i], tables[j]
+		if a.Level != b.Level {
+			return a.Level < b.Level
+		}
+		if a.Level > 0 && a.SmallestKey != b.SmallestKey {
+			return a.SmallestKey < b.SmallestKey
+		}
+		if a.LargestSeq != b.LargestSeq {
+			return a.LargestSeq > b.LargestSeq
+		}
+		return a.num > b.num
+	})
+}
+
+// Search looks up the newest version of searchkey in this table. found is also true for a
+// tombstone, so the caller knows to stop looking in older tables.
+func (sst *SSTable) Search(searchkey string) (Entry, bool, error) {
+	return sst.searchAt(searchkey, math.MaxUint64)
+}
+
+// searchAt returns the newest version of searchkey with a sequence number <= maxSeq.
+// Versions of a key are stored newest first, so that is the first one that qualifies.
+func (sst *SSTable) searchAt(searchkey string, maxSeq uint64) (Entry, bool, error) {
+	if !sst.mayContainKey(searchkey) {
+		return Entry{}, false, nil
+	}
 	if sst.Filter != nil {
 		if !sst.Filter.Contains([]byte(searchkey)) {
-			return nil, false, nil
+			sst.filterNegatives.Add(1)
+			return Entry{}, false, nil
 		}
 	}
-	f, err := os.Open(sst.Filename)
+	it, err := sst.NewIterator()
 	if err != nil {
-		return nil, false, err
+		return Entry{}, false, err
 	}
-	defer f.Close()
+	defer it.Close()
 
-	stat, _ := f.Stat()
-	fileSize := stat.Size()
-	dataEnd := fileSize
-	if fileSize > 16 {
-		f.Seek(-16, io.SeekEnd)
-		var filterLen, indexLen uint64
-		binary.Read(f, binary.LittleEndian, &filterLen)
-		binary.Read(f, binary.LittleEndian, &indexLen)
-		dataEnd = fileSize - 16 - int64(filterLen) - int64(indexLen)
-	}
-
-	var startOffset int64 = 0
-	// Index Lookup: Jump to the closest offset
-	if len(sst.Index) > 0 {
-		idx := sort.Search(len(sst.Index), func(i int) bool {
-			return sst.Index[i].Key > searchkey
-		})
-		if idx > 0 {
-			startOffset = sst.Index[idx-1].Offset
+	// Seek lands on the newest version; older ones may continue into the next block
+	held := false
+	for it.Seek(searchkey); it.Valid() && it.Key() == searchkey; it.Next() {
+		held = true
+		if entry := it.Entry(); entry.Seq <= maxSeq {
+			return entry, true, nil
 		}
 	}
-	f.Seek(startOffset, io.SeekStart)
+	if !held && sst.Filter != nil && it.Err() == nil {
+		sst.filterFalsePositives.Add(1) // the filter let through a key the table doesn't hold
+	}
+	return Entry{}, false, it.Err()
+}
+
+// Scan loads the newest version of every key into memory. Prefer NewIterator for anything that can stream.
+func (sst *SSTable) Scan() (map[string]Entry, error) {
+	versions, err := sst.scanVersions()
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]Entry, len(versions))
+	for k, v := range versions {
+		data[k] = v[0]
+	}
+	return data, nil
+}
 
-	for {
-		currentPos, _ := f.Seek(0, io.SeekCurrent)
-		if currentPos >= dataEnd {
-			break
+// scanVersions loads every version of every key, newest first.
+func (sst *SSTable) scanVersions() (map[string][]Entry, error) {
+	it, err := sst.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	data := make(map[string][]Entry)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		data[it.Key()] = append(data[it.Key()], it.Entry())
+	}
+	return data, it.Err()
+}
+
+// sstFooterSize is the fixed tail of a flat table: File = [Data][Filter][Index][filterLen u64][indexLen u64]
+const sstFooterSize = 16
+
+// Block tables end in a versioned footer instead:
+//
+//	[props offset u64][props size u64][filter offset u64][filter size u64][index offset u64][index size u64][version u32][magic u64]
+//
+// The magic number can't be mistaken for the index length a flat table ends with. Every
+// block the handles point at (data, filter, index, properties) is followed by a trailer,
+// [type][crc32c u32], naming its compression and checksumming its contents and the type byte.
+// Handles cover the contents only.
+const (
+	blockFooterSize    = 60
+	blockFooterVersion = 1
+	sstMagic           = 0x6368696c6c2d6462 // "chill-db"
+)
+
+type blockFooter struct {
+	props   blockHandle // the properties block, see tableProperties
+	filter  blockHandle
+	index   blockHandle
+	version uint32
+}
+
+func (ft blockFooter) encode() []byte {
+	var buf [blockFooterSize]byte
+	binary.LittleEndian.PutUint64(buf[0:8], ft.props.offset)
+	binary.LittleEndian.PutUint64(buf[8:16], ft.props.size)
+	binary.LittleEndian.PutUint64(buf[16:24], ft.filter.offset)
+	binary.LittleEndian.PutUint64(buf[24:32], ft.filter.size)
+	binary.LittleEndian.PutUint64(buf[32:40], ft.index.offset)
+	binary.LittleEndian.PutUint64(buf[40:48], ft.index.size)
+	binary.LittleEndian.PutUint32(buf[48:52], ft.version)
+	binary.LittleEndian.PutUint64(buf[52:60], sstMagic)
+	return buf[:]
+}
+
+// readBlockFooter returns the footer of a block table; ok is false for a flat table.
+func readBlockFooter(f *os.File, fileSize int64) (footer blockFooter, ok bool, err error) {
+	if fileSize < blockFooterSize {
+		return blockFooter{}, false, nil
+	}
+	var buf [blockFooterSize]byte
+	if _, err := f.ReadAt(buf[:], fileSize-blockFooterSize); err != nil {
+		return blockFooter{}, false, err
+	}
+	if binary.LittleEndian.Uint64(buf[52:60]) != sstMagic {
+		return blockFooter{}, false, nil
+	}
+	footer = blockFooter{
+		props:   blockHandle{binary.LittleEndian.Uint64(buf[0:8]), binary.LittleEndian.Uint64(buf[8:16])},
+		filter:  blockHandle{binary.LittleEndian.Uint64(buf[16:24]), binary.LittleEndian.Uint64(buf[24:32])},
+		index:   blockHandle{binary.LittleEndian.Uint64(buf[32:40]), binary.LittleEndian.Uint64(buf[40:48])},
+		version: binary.LittleEndian.Uint32(buf[48:52]),
+	}
+	if footer.version != blockFooterVersion {
+		return blockFooter{}, false, fmt.Errorf("sstable %s: unsupported footer version %d", f.Name(), footer.version)
+	}
+	// Compared without adding offset and size, which a damaged footer could make wrap around
+	body := uint64(fileSize - blockFooterSize)
+	for _, h := range []blockHandle{footer.props, footer.filter, footer.index} {
+		if h.offset > body || h.size > body-h.offset || blockTrailerSize > body-h.offset-h.size {
+			return blockFooter{}, false, &CorruptionError{File: f.Name(), Offset: int64(body), Reason: "footer handles exceed the file size"}
 		}
+	}
+	return footer, true, nil
+}
 
-		var keyLen, valLen int32
-		if err := binary.Read(f, binary.LittleEndian, &keyLen); err != nil {
-			break
+// view returns the bytes at h: a slice of the mapping if the file is mapped (mapped = true,
+// only valid until fh is released), otherwise a fresh buffer read with pread.
+func (sst *SSTable) view(fh *tableHandle, h blockHandle) (buf []byte, mapped bool, err error) {
+	if fh.mapped != nil {
+		if n := uint64(len(fh.mapped)); h.offset > n || h.size > n-h.offset {
+			return nil, false, sst.corruption(int64(h.offset), "truncated: block of %d bytes runs past the end of the file", h.size)
 		}
-		if err := binary.Read(f, binary.LittleEndian, &valLen); err != nil {
-			break
+		return fh.mapped[h.offset : h.offset+h.size], true, nil
+	}
+	buf = make([]byte, h.size)
+	if _, err := fh.f.ReadAt(buf, int64(h.offset)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, false, sst.corruption(int64(h.offset), "truncated: block of %d bytes runs past the end of the file", h.size)
 		}
+		return nil, false, fmt.Errorf("sstable %s: reading block at %d: %w", sst.Filename, h.offset, err)
+	}
+	return buf, false, nil
+}
 
-		keyBytes := make([]byte, int(keyLen))
-		if _, err := io.ReadFull(f, keyBytes); err != nil {
-			break
+// readBlock reads the block at h, checks its checksum and decompresses it. From a mapped
+// file a compressed block is decompressed straight out of the mapping; a raw one is copied,
+// since blocks outlive the handle (in the block cache, in the entries read from them).
+func (sst *SSTable) readBlock(h blockHandle) ([]byte, error) {
+	fh, err := sst.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer sst.release(fh)
+	buf, mapped, err := sst.view(fh, blockHandle{offset: h.offset, size: h.size + blockTrailerSize})
+	if err != nil {
+		return nil, err
+	}
+	want := binary.LittleEndian.Uint32(buf[h.size+1:])
+	if got := crc32.Checksum(buf[:h.size+1], crcTable); got != want {
+		return nil, sst.corruption(int64(h.offset), "block checksum mismatch (stored %08x, computed %08x)", want, got)
+	}
+	typ := buf[h.size]
+	if typ == blockTypeRaw {
+		if mapped {
+			return bytes.Clone(buf[:h.size]), nil
 		}
-		keyStr := string(keyBytes)
+		return buf[:h.size], nil
+	}
+	data, err := decompressBlock(typ, buf[:h.size])
+	if err != nil {
+		return nil, sst.corruption(int64(h.offset), "%v", err)
+	}
+	return data, nil
+}
 
-		// Optimization: Since SSTable is sorted, if we pass the key, it's not here
-		if keyStr > searchkey {
-			return nil, false, nil
-		}
+// readDataEnd reads the footer of a flat table and returns the offset where the data records stop.
+func readDataEnd(f *os.File) (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileSize := stat.Size()
+	if fileSize < sstFooterSize {
+		return 0, &CorruptionError{File: f.Name(), Reason: fmt.Sprintf("file too small for a footer (%d bytes)", fileSize)}
+	}
 
-		if keyStr == searchkey {
-			valBytes := make([]byte, int(valLen))
-			io.ReadFull(f, valBytes)
-			return valBytes, true, nil
-		}
+	var footer [sstFooterSize]byte
+	if _, err := f.ReadAt(footer[:], fileSize-sstFooterSize); err != nil {
+		return 0, err
+	}
+	filterLen := binary.LittleEndian.Uint64(footer[0:8])
+	indexLen := binary.LittleEndian.Uint64(footer[8:16])
+
+	// Bounded as they are: converted to int64 first, a damaged length could go negative
+	body := uint64(fileSize - sstFooterSize)
+	if filterLen > body || indexLen > body-filterLen {
+		return 0, &CorruptionError{File: f.Name(), Offset: fileSize - sstFooterSize, Reason: "footer lengths exceed the file size"}
+	}
+	return int64(body - filterLen - indexLen), nil
+}
 
-		// Skip value to next record
-		f.Seek(int64(valLen), io.SeekCurrent)
+// NewIterator returns an iterator over the table. Call Seek or SeekToFirst before use and Close when done.
+func (sst *SSTable) NewIterator() (internalIterator, error) {
+	return sst.newIterator(true)
+}
+
+// newScanIterator is NewIterator for reads of the whole table (compaction, verify): the
+// blocks it reads don't go into the block cache, where they would push out the hot ones.
+func (sst *SSTable) newScanIterator() (internalIterator, error) {
+	return sst.newIterator(false)
+}
+
+func (sst *SSTable) newIterator(fillCache bool) (internalIterator, error) {
+	if sst.err != nil {
+		return nil, sst.err
+	}
+	if sst.format == sstFormatBlock {
+		return &tableIterator{sst: sst, fillCache: fillCache}, nil
 	}
-	return nil, false, nil
+	return sst.newFlatIterator(), nil
 }
 
-func (sst *SSTable) Scan() (map[string][]byte, error) {
-	f, err := os.Open(sst.Filename)
+// dataBlock returns the data block at h, from the block cache if it is there.
+func (sst *SSTable) dataBlock(h blockHandle, fillCache bool) (*block, error) {
+	key := blockKey{table: sst.num, offset: h.offset}
+	if sst.bcache != nil && fillCache {
+		if b, ok := sst.bcache.get(key); ok {
+			return b, nil
+		}
+	}
+	raw, err := sst.readBlock(h)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	b, err := parseBlock(raw)
+	if err != nil {
+		return nil, sst.corruption(int64(h.offset), "%v", err)
+	}
+	if sst.bcache != nil && fillCache {
+		sst.bcache.add(key, b)
+	}
+	return b, nil
+}
 
-	// 1. Calculate where the Data actually ends
-	stat, _ := f.Stat()
-	fileSize := stat.Size()
-	dataEnd := fileSize // Default: Read whole file
-
-	// Check if there is a footer (Filter Length)
-	if fileSize > 8 {
-		// Read last 8 bytes
-		if _, err := f.Seek(-8, 2); err == nil {
-			var filterLen uint64
-			if err := binary.Read(f, binary.LittleEndian, &filterLen); err == nil {
-				// Sanity check: Filter + Footer shouldn't be larger than the file
-				if int64(filterLen+8) < fileSize {
-					// FOUND IT! The data stops before the filter.
-					dataEnd = fileSize - 8 - int64(filterLen)
-				}
-			}
+// tableIterator walks a block table: the index block picks the data block, a blockIter walks it.
+type tableIterator struct {
+	sst       *SSTable
+	fillCache bool // add the blocks read to the block cache
+	idx       int  // data block the blockIter is on
+	blk       *blockIter
+	key       string
+	entry     Entry
+	valid     bool
+	err       error
+}
+
+// loadBlock moves to data block i. false past the last block or on error.
+func (it *tableIterator) loadBlock(i int) bool {
+	it.valid = false
+	if it.err != nil || i >= len(it.sst.blocks) {
+		return false
+	}
+	b, err := it.sst.dataBlock(it.sst.blocks[i].handle, it.fillCache)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.idx, it.blk = i, newBlockIter(b)
+	return true
+}
+
+// settle moves on to the next block while the current one is exhausted, then decodes the entry.
+func (it *tableIterator) settle() {
+	for !it.blk.Valid() {
+		if it.blk.err != nil {
+			it.err = it.sst.corruption(int64(it.sst.blocks[it.idx].handle.offset), "%v", it.blk.err)
+			return
+		}
+		if !it.loadBlock(it.idx + 1) {
+			return
 		}
+		it.blk.SeekToFirst()
+	}
+	entry, err := decodeDataPayload(it.blk.payload)
+	if err != nil {
+		it.err = it.sst.corruption(int64(it.sst.blocks[it.idx].handle.offset), "%v: bad data entry", err)
+		it.valid = false
+		return
 	}
+	it.key, it.entry, it.valid = string(it.blk.key), entry, true
+}
 
-	// 2. Rewind to start
-	if _, err := f.Seek(0, 0); err != nil {
-		return nil, err
+func (it *tableIterator) SeekToFirst() {
+	if it.loadBlock(0) {
+		it.blk.SeekToFirst()
+		it.settle()
+	}
+}
+
+// Seek positions the iterator at the newest version of the first key >= key. That is in the
+// first block whose last key is >= key, even when the versions of key straddle two blocks.
+func (it *tableIterator) Seek(key string) {
+	i := sort.Search(len(it.sst.blocks), func(i int) bool {
+		return it.sst.blocks[i].lastKey >= key
+	})
+	if it.loadBlock(i) {
+		it.blk.Seek(key)
+		it.settle()
 	}
+}
 
-	data := make(map[string][]byte)
+func (it *tableIterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.blk.Next()
+	it.settle()
+}
 
-	// 3. Read Loop with strict limit
-	for {
-		// STOP CHECK: Have we reached the Bloom Filter?
-		currentPos, _ := f.Seek(0, 1)
-		if currentPos >= dataEnd {
-			break
-		}
+func (it *tableIterator) Valid() bool  { return it.valid }
+func (it *tableIterator) Key() string  { return it.key }
+func (it *tableIterator) Entry() Entry { return it.entry }
+func (it *tableIterator) Err() error   { return it.err }
+func (it *tableIterator) Close() error { return nil }
 
-		var keyLen int32
-		if err := binary.Read(f, binary.LittleEndian, &keyLen); err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
+// seekOffset uses the sparse index of a flat table to find where to start reading for key:
+// the offset of the last indexed key < key (or 0). Strictly less, because the versions
+// of a key can straddle an index point and the newest one may come before it.
+func (sst *SSTable) seekOffset(key string) int64 {
+	idx := sort.Search(len(sst.Index), func(i int) bool {
+		return sst.Index[i].Key >= key
+	})
+	if idx > 0 {
+		return sst.Index[idx-1].Offset
+	}
+	return 0
+}
 
-		// Double check: Did reading keyLen push us past the limit?
-		// (This handles corrupted files nicely)
-		if int64(keyLen)+currentPos > dataEnd {
-			break
-		}
+// sstIterator reads the data section of a flat table sequentially through a buffered reader.
+type sstIterator struct {
+	sst   *SSTable
+	fh    *tableHandle // held from the first seek until Close
+	r     *bufio.Reader
+	pos   int64 // offset of the next record to decode
+	key   string
+	entry Entry
+	valid bool
+	err   error
+}
 
-		var valLen int32
-		if err := binary.Read(f, binary.LittleEndian, &valLen); err != nil {
-			return nil, err
+func (sst *SSTable) newFlatIterator() *sstIterator {
+	return &sstIterator{sst: sst}
+}
+
+func (it *sstIterator) seekTo(offset int64) {
+	it.valid = false
+	if it.err != nil {
+		return
+	}
+	if it.fh == nil {
+		if it.fh, it.err = it.sst.acquire(); it.err != nil {
+			return
 		}
+	}
+	var file io.ReaderAt = it.fh.f
+	if it.fh.mapped != nil {
+		file = bytes.NewReader(it.fh.mapped) // copies out of the mapping, no syscalls
+	}
+	section := io.NewSectionReader(file, offset, it.sst.dataEnd-offset)
+	if it.r == nil {
+		it.r = bufio.NewReaderSize(section, 8*1024)
+	} else {
+		it.r.Reset(section)
+	}
+	it.pos = offset
+	it.Next()
+}
 
-		keyBytes := make([]byte, int(keyLen))
-		valBytes := make([]byte, int(valLen))
+func (it *sstIterator) SeekToFirst() { it.seekTo(0) }
 
-		if _, err := io.ReadFull(f, keyBytes); err != nil {
-			return nil, err
-		}
-		if _, err := io.ReadFull(f, valBytes); err != nil {
-			return nil, err
+// Seek positions the iterator at the newest version of the first key >= key.
+func (it *sstIterator) Seek(key string) {
+	it.seekTo(it.sst.seekOffset(key))
+	for it.valid && it.key < key {
+		it.Next()
+	}
+}
+
+func (it *sstIterator) Next() {
+	it.valid = false
+	if it.err != nil || it.pos >= it.sst.dataEnd {
+		return
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(it.r, header[:]); err != nil {
+		it.err = it.sst.corruption(it.pos, "reading record: %v", err)
+		return
+	}
+	keyLen := int32(binary.LittleEndian.Uint32(header[0:4]))
+	valLen := int32(binary.LittleEndian.Uint32(header[4:8]))
+	recordLen := int64(len(header)) + int64(keyLen)
+	if valLen > 0 {
+		recordLen += int64(valLen)
+	}
+	if keyLen < 0 || valLen < tombstoneLen || it.pos+recordLen > it.sst.dataEnd {
+		it.err = it.sst.corruption(it.pos, "bad record header")
+		return
+	}
+
+	keyBytes := make([]byte, keyLen)
+	if _, err := io.ReadFull(it.r, keyBytes); err != nil {
+		it.err = err
+		return
+	}
+	it.key = string(keyBytes)
+	// Flat tables predate sequence numbers: every version is Seq 0, older than any write since
+	if valLen == tombstoneLen {
+		it.entry = Entry{Tombstone: true}
+	} else {
+		val := make([]byte, valLen)
+		if _, err := io.ReadFull(it.r, val); err != nil {
+			it.err = err
+			return
 		}
+		it.entry = Entry{Value: val}
+	}
+	it.pos += recordLen
+	it.valid = true
+}
 
-		data[string(keyBytes)] = valBytes
+func (it *sstIterator) Valid() bool  { return it.valid }
+func (it *sstIterator) Key() string  { return it.key }
+func (it *sstIterator) Entry() Entry { return it.entry }
+func (it *sstIterator) Err() error   { return it.err }
+func (it *sstIterator) Close() error {
+	if it.fh != nil {
+		it.sst.release(it.fh)
+		it.fh = nil
 	}
+	return nil
+}
 
-	return data, nil
+// sortedSource is what WriteSSTable consumes: entries in ascending key order (the versions
+// of a key newest first), already positioned on the first one. The MemTable's skiplist iterator is one.
+type sortedSource interface {
+	Valid() bool
+	Next()
+	Key() string
+	Entry() Entry
 }
 
-func WriteSSTable(data map[string][]byte, filename string) (*SSTable, error) {
-	keys := make([]string, 0, len(data))
-	for k := range data {
-		keys = append(keys, k)
+// WriteSSTable streams src to a new file, with the default block size and compression.
+func WriteSSTable(src sortedSource, filename string) (*SSTable, error) {
+	return writeSSTable(src, filename, DefaultOptions().tableOptions(nil))
+}
+
+// tableOptions is what the SSTable writer takes from Options.
+type tableOptions struct {
+	blockSize   int
+	compression Compression
+	fpRate      float64           // the Bloom filter's target false-positive rate
+	prefixes    PrefixExtractor   // nil: only whole keys go into the filter
+	stats       *compressionStats // nil: not counted anywhere
+}
+
+func (o Options) tableOptions(stats *compressionStats) tableOptions {
+	return tableOptions{blockSize: o.BlockSize, compression: o.Compression, fpRate: o.BloomFPRate, prefixes: o.PrefixExtractor, stats: stats}
+}
+
+func writeSSTable(src sortedSource, filename string, opts tableOptions) (*SSTable, error) {
+	w, err := newSSTWriter(filename, opts)
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(keys)
+	for ; src.Valid(); src.Next() {
+		if err := w.add(src.Key(), src.Entry()); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	return w.finish()
+}
+
+// sstWriter builds a block table one record at a time, so a compaction can stream its
+// output and cut it into several files. Records must come in ascending key order (the
+// versions of a key newest first). Besides the buffered writer, it keeps in memory the
+// data block being filled, the index (one entry per block) and one hash per key for the
+// Bloom filter: all of them grow with the file, never with the total amount of data.
+type sstWriter struct {
+	f        *os.File
+	w        *bufio.Writer
+	filename string
+	opts     tableOptions
 
+	data     *blockBuilder
+	comp     blockCompressor
+	payload  []byte       // scratch buffer for encoding one entry
+	blocks   []indexEntry // handed to the finished table, so it doesn't read its index back
+	hashes   [][2]uint64  // one per distinct key and prefix, added to the filter at finish (its size depends on the count)
+	offset   int64        // bytes of finished blocks written so far
+	records  int
+	smallest string
+	largest  string
+	minSeq   uint64
+	maxSeq   uint64
+
+	lastPrefix string // the last prefix added to hashes, if hasPrefix
+	hasPrefix  bool
+}
+
+func newSSTWriter(filename string, opts tableOptions) (*sstWriter, error) {
 	f, err := os.Create(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	return &sstWriter{
+		f:        f,
+		w:        bufio.NewWriterSize(f, 64*1024),
+		filename: filename,
+		opts:     opts,
+		data:     newBlockBuilder(blockRestartInterval),
+		comp:     blockCompressor{c: opts.compression},
+	}, nil
+}
 
-	var index []IndexEntry
-	bf := NewBloomFilter(uint64(len(keys)*10), 7)
-	currentOffset := int64(0)
+func (w *sstWriter) add(k string, entry Entry) error {
+	// Remember the key for the Bloom filter (once, however many versions it has)
+	if w.records == 0 || k != w.largest {
+		h1, h2 := bloomHash([]byte(k))
+		w.hashes = append(w.hashes, [2]uint64{h1, h2})
+		// Keys come sorted, so the keys sharing a prefix come together: add it once per run
+		if w.opts.prefixes != nil {
+			if p, ok := w.opts.prefixes.Prefix(k); ok && (!w.hasPrefix || p != w.lastPrefix) {
+				h1, h2 := bloomHash([]byte(p))
+				w.hashes = append(w.hashes, [2]uint64{h1, h2})
+				w.lastPrefix, w.hasPrefix = p, true
+			}
+		}
+	}
+	if w.records == 0 {
+		w.smallest, w.minSeq = k, entry.Seq
+	}
+	w.largest = k
+	w.minSeq, w.maxSeq = min(w.minSeq, entry.Seq), max(w.maxSeq, entry.Seq)
+	w.records++
+
+	w.payload = encodeDataPayload(w.payload[:0], entry)
+	w.data.add(k, w.payload)
+	if w.data.estimatedSize() >= w.opts.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock compresses and writes out the data block being filled, and indexes it under its last key.
+func (w *sstWriter) flushBlock() error {
+	raw := w.data.finish()
+	stored, typ := w.comp.compress(raw)
+	w.opts.stats.add(len(raw), len(stored), typ)
+	handle, err := w.writeBlock(stored, typ)
+	if err != nil {
+		return err
+	}
+	w.blocks = append(w.blocks, indexEntry{lastKey: w.largest, handle: handle})
+	return nil
+}
 
-	for i, k := range keys {
-		val := data[k]
+// writeBlock appends a block and its trailer, [type][crc32c of data and type], to the file.
+func (w *sstWriter) writeBlock(data []byte, typ byte) (blockHandle, error) {
+	handle := blockHandle{offset: uint64(w.offset), size: uint64(len(data))}
+	var trailer [blockTrailerSize]byte
+	trailer[0] = typ
+	crc := crc32.Update(crc32.Checksum(data, crcTable), crcTable, trailer[:1])
+	binary.LittleEndian.PutUint32(trailer[1:], crc)
+	w.w.Write(data)
+	if _, err := w.w.Write(trailer[:]); err != nil {
+		return handle, err // bufio.Writer errors are sticky, so this covers earlier writes too
+	}
+	w.offset += int64(len(data) + blockTrailerSize)
+	return handle, nil
+}
 
-		// 1. Update Index: Every 100 keys, record the offset
-		if i%100 == 0 {
-			index = append(index, IndexEntry{Key: k, Offset: currentOffset})
+// size is roughly how big the table is so far: the finished blocks plus the one being filled
+// (uncompressed, so a little more than it will take).
+func (w *sstWriter) size() int64 { return w.offset + int64(len(w.data.buf)) }
+
+// finish writes the last block, the filter, the index block and the footer and syncs the
+// file. The table isn't published anywhere yet.
+func (w *sstWriter) finish() (*SSTable, error) {
+	if w.data.entries > 0 {
+		if err := w.flushBlock(); err != nil {
+			w.abort()
+			return nil, err
 		}
+	}
 
-		// 2. Update Bloom Filter
-		bf.Add(k)
+	bf := NewBloomFilterFor(len(w.hashes), w.opts.fpRate)
+	for _, h := range w.hashes {
+		bf.addHash(h[0], h[1])
+	}
+	if pe := w.opts.prefixes; pe != nil && len(pe.Name()) <= 255 {
+		bf.prefixes = pe.Name() // a longer name doesn't fit the encoding: the prefixes go unused
+	}
+	bfData := bf.Encode()
+	footer := blockFooter{version: blockFooterVersion}
+	footer.filter, _ = w.writeBlock(bfData, blockTypeRaw) // checksummed like a block, never compressed
 
-		// 3. Write Data
-		keyLen := int32(len(k))
-		valLen := int32(len(val))
+	// Every index entry is a restart point: the reader decodes the whole index once anyway.
+	// It is read once per open, so it isn't compressed.
+	index := newBlockBuilder(1)
+	var handle []byte
+	for _, e := range w.blocks {
+		handle = e.handle.encode(handle[:0])
+		index.add(e.lastKey, handle)
+	}
+	footer.index, _ = w.writeBlock(index.finish(), blockTypeRaw)
+	props := tableProperties{entries: int64(w.records)}
+	if w.records > 0 {
+		props.smallest, props.largest, props.hasKeys = w.smallest, w.largest, true
+	}
+	footer.props, _ = w.writeBlock(props.encode(), blockTypeRaw)
+	w.w.Write(footer.encode())
+	w.offset += blockFooterSize
 
-		binary.Write(f, binary.LittleEndian, keyLen)
-		binary.Write(f, binary.LittleEndian, valLen)
-		f.WriteString(k)
-		f.Write(val)
+	if err := w.w.Flush(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.filename)
+		return nil, err
+	}
 
-		// 4. Track Offset: 4+4 bytes for lengths + actual data
-		currentOffset += int64(8 + keyLen + valLen)
+	sst := &SSTable{
+		Filename:    w.filename,
+		Filter:      bf,
+		SmallestSeq: w.minSeq,
+		LargestSeq:  w.maxSeq,
+		SmallestKey: w.smallest,
+		LargestKey:  w.largest,
+		Size:        w.offset,
+		format:      sstFormatBlock,
+		blocks:      w.blocks,
+		entries:     int64(w.records),
+		keyRange:    w.records > 0,
 	}
+	return sst, nil
+}
 
-	// Write Bloom Filter and Footer (Same as your logic)
-	bfData := bf.Encode()
-	indexData, _ := EncodeIndex(index)
-	f.Write(bfData)
-	f.Write(indexData)
-	binary.Write(f, binary.LittleEndian, uint64(len(bfData)))
-	binary.Write(f, binary.LittleEndian, uint64(len(indexData)))
-
-	f.Sync()
-
-	return &SSTable{
-		Filename: filename,
-		Filter:   bf,
-		Index:    index, // Now properly populated!
-	}, nil
+// abort closes and deletes a table that won't be finished.
+func (w *sstWriter) abort() {
+	w.f.Close()
+	os.Remove(w.filename)
 }
 
+// indexEntry is one entry of a block table's index: the last key of a data block and where the block is.
+type indexEntry struct {
+	lastKey string
+	handle  blockHandle
+}
+
+// LoadMetadata opens the table and loads its filter and index. A block table is recognized
+// by its footer's magic number; anything else is read as a flat table, unless the MANIFEST
+// says it is a block table.
 func (sst *SSTable) LoadMetadata() error {
-	f, err := os.Open(sst.Filename)
+	fh, err := sst.acquire()
+	if err != nil {
+		return err
+	}
+	defer sst.release(fh)
+	stat, err := fh.f.Stat()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	stat, _ := f.Stat()
 	size := stat.Size()
-	if size < 16 {
+
+	footer, ok, err := readBlockFooter(fh.f, size)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return sst.loadBlockMetadata(footer)
+	}
+
+	if size < sstFooterSize {
 		return nil
 	} // Too small for metadata
+	if sst.format == sstFormatBlock {
+		return sst.corruption(size-blockFooterSize, "block table without a valid footer")
+	}
+	if sst.dataEnd, err = readDataEnd(fh.f); err != nil {
+		return err
+	}
 
-	// 1. Read the two lengths from the very end
-	f.Seek(-16, io.SeekEnd)
-	var filterLen, indexLen uint64
-	binary.Read(f, binary.LittleEndian, &filterLen)
-	binary.Read(f, binary.LittleEndian, &indexLen)
-
-	// 2. Load Filter
-	// Offset calculation: TotalSize - Footer(16) - IndexLen - FilterLen
-	filterOffset := size - 16 - int64(indexLen) - int64(filterLen)
-	f.Seek(filterOffset, io.SeekStart)
-	filterData := make([]byte, filterLen)
-	f.Read(filterData)
-	sst.Filter = DecodeBloomFilter(filterData)
-
-	// 3. Load Index
-	// The index starts right after the filter
-	indexData := make([]byte, indexLen)
-	f.Read(indexData)
-	sst.Index, err = DecodeIndex(indexData) // Use a simple decoder (like JSON or binary)
+	// [Data][Filter][Index][filterLen u64][indexLen u64]: read all but the data in one go
+	meta := make([]byte, size-sst.dataEnd)
+	if _, err := fh.f.ReadAt(meta, sst.dataEnd); err != nil {
+		return err
+	}
+	// Flat tables have no checksums: a gob index that doesn't decode is all we can catch
+	filterLen := binary.LittleEndian.Uint64(meta[len(meta)-sstFooterSize:])
+	sst.Filter = decodeLegacyBloomFilter(meta[:filterLen]) // nil (no filtering) if it doesn't decode
+	if sst.Index, err = DecodeIndex(meta[filterLen : len(meta)-sstFooterSize]); err != nil {
+		return sst.corruption(sst.dataEnd+int64(filterLen), "index: %v", err)
+	}
+	return nil
+}
+
+// LoadFilter loads the Bloom filter, whatever the table format. The index comes with it:
+// both live at the end of the file and are read together by LoadMetadata.
+func (sst *SSTable) LoadFilter() error {
+	return sst.LoadMetadata()
+}
+
+// loadBlockMetadata reads the filter, the index block and the properties block of a block table.
+func (sst *SSTable) loadBlockMetadata(footer blockFooter) error {
+	sst.format = sstFormatBlock
+	filterData, err := sst.readBlock(footer.filter)
 	if err != nil {
 		return err
 	}
+	if sst.Filter = DecodeBloomFilter(filterData); sst.Filter == nil {
+		return sst.corruption(int64(footer.filter.offset), "filter doesn't decode")
+	}
+
+	raw, err := sst.readBlock(footer.index)
+	if err != nil {
+		return err
+	}
+	b, err := parseBlock(raw)
+	if err != nil {
+		return sst.corruption(int64(footer.index.offset), "index block: %v", err)
+	}
+	sst.blocks = sst.blocks[:0]
+	it := newBlockIter(b)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		h, err := decodeBlockHandle(it.payload)
+		if err != nil {
+			return sst.corruption(int64(footer.index.offset), "index block: %v", err)
+		}
+		sst.blocks = append(sst.blocks, indexEntry{lastKey: string(it.key), handle: h})
+	}
+	if it.err != nil {
+		return sst.corruption(int64(footer.index.offset), "index block: %v", it.err)
+	}
 
+	raw, err = sst.readBlock(footer.props)
+	if err != nil {
+		return err
+	}
+	props, err := decodeTableProperties(raw)
+	if err != nil {
+		return sst.corruption(int64(footer.props.offset), "properties block: %v", err)
+	}
+	sst.entries = props.entries
+	// The file knows best: it overrides what the MANIFEST said
+	sst.SmallestKey, sst.LargestKey, sst.keyRange = props.smallest, props.largest, props.hasKeys
 	return nil
 }
 
+// tableProperties is the properties block of a block table:
+//
+//	[flags u8][entries uvarint][smallest len uvarint][smallest][largest len uvarint][largest]
+//
+// Flag 1 says the keys are there: a table without entries has no key range.
+type tableProperties struct {
+	entries           int64
+	hasKeys           bool
+	smallest, largest string
+}
+
+func (p tableProperties) encode() []byte {
+	var buf []byte
+	if p.hasKeys {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(p.entries))
+	for _, k := range []string{p.smallest, p.largest} {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+	}
+	return buf
+}
+
+func decodeTableProperties(data []byte) (tableProperties, error) {
+	if len(data) < 1 || data[0] > 1 {
+		return tableProperties{}, errors.New("bad flags")
+	}
+	p := tableProperties{hasKeys: data[0] == 1}
+	entries, n := binary.Uvarint(data[1:])
+	if n <= 0 || entries > math.MaxInt64 {
+		return tableProperties{}, errors.New("bad entry count")
+	}
+	p.entries, data = int64(entries), data[1+n:]
+	var keys [2]string
+	for i := range keys {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return tableProperties{}, errors.New("bad key length")
+		}
+		keys[i], data = string(data[n:n+int(l)]), data[n+int(l):]
+	}
+	p.smallest, p.largest = keys[0], keys[1]
+	return p, nil
+}
+
+// verify reads the whole table, checking every checksum and that the keys are in order.
+// ParanoidChecks runs it on every table at open and on every new table before it is published.
+func (sst *SSTable) verify() error {
+	it, err := sst.newScanIterator()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	var prev string
+	var prevSeq uint64
+	first := true
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key, seq := it.Key(), it.Entry().Seq
+		if !first && (key < prev || (key == prev && seq > prevSeq)) {
+			return sst.corruption(0, "entries out of order: %q@%d after %q@%d", key, seq, prev, prevSeq)
+		}
+		prev, prevSeq, first = key, seq, false
+	}
+	return it.Err()
+}
+
 func EncodeIndex(index []IndexEntry) ([]byte, error) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -0,0 +1,460 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chill-db/internal/domain"
+)
+
+// sliceSource feeds WriteSSTable from a slice already in table order.
+type sliceSource struct {
+	keys    []string
+	entries []Entry
+	i       int
+}
+
+func (s *sliceSource) Valid() bool  { return s.i < len(s.keys) }
+func (s *sliceSource) Next()        { s.i++ }
+func (s *sliceSource) Key() string  { return s.keys[s.i] }
+func (s *sliceSource) Entry() Entry { return s.entries[s.i] }
+
+// Small blocks, so keys with several versions straddle block boundaries and restart points.
+func TestBlockTableRoundTrip(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionFlate} {
+		t.Run(c.String(), func(t *testing.T) { testBlockTableRoundTrip(t, c) })
+	}
+}
+
+func testBlockTableRoundTrip(t *testing.T, compression Compression) {
+	src := &sliceSource{}
+	seq := uint64(1000)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%05d", i*2) // odd numbers are missing
+		for v := i % 4; v >= 0; v-- {
+			seq--
+			entry := Entry{Value: []byte(fmt.Sprintf("%s-v%d", key, v)), Seq: seq}
+			if i%7 == 0 && v == 0 {
+				entry = Entry{Tombstone: true, Seq: seq}
+			}
+			src.keys = append(src.keys, key)
+			src.entries = append(src.entries, entry)
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "sst_000001.db")
+	var stats compressionStats
+	written, err := writeSSTable(src, filename, tableOptions{blockSize: 256, compression: compression, stats: &stats})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.snapshot(); (got.CompressedBlocks > 0) != (compression != CompressionNone) || got.Blocks != int64(len(written.blocks)) {
+		t.Fatalf("stats %+v for %d blocks", got, len(written.blocks))
+	}
+	defer written.closeFile()
+	if len(written.blocks) < 10 {
+		t.Fatalf("only %d blocks written", len(written.blocks))
+	}
+
+	// Read it back the way an open does: format from the footer, index from the index block
+	reopened := &SSTable{Filename: filename, format: sstFormatLegacy}
+	if err := reopened.LoadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.closeFile()
+	if reopened.format != sstFormatBlock || len(reopened.blocks) != len(written.blocks) {
+		t.Fatalf("reopened as format %d with %d blocks, want %d blocks", reopened.format, len(reopened.blocks), len(written.blocks))
+	}
+	if err := reopened.loadKeyRange(); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.SmallestKey != written.SmallestKey || reopened.LargestKey != written.LargestKey {
+		t.Fatalf("key range [%s, %s], want [%s, %s]", reopened.SmallestKey, reopened.LargestKey, written.SmallestKey, written.LargestKey)
+	}
+
+	for _, sst := range []*SSTable{written, reopened} {
+		it, err := sst.NewIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if it.Key() != src.keys[i] || it.Entry().Seq != src.entries[i].Seq || string(it.Entry().Value) != string(src.entries[i].Value) {
+				t.Fatalf("record %d = %s@%d, want %s@%d", i, it.Key(), it.Entry().Seq, src.keys[i], src.entries[i].Seq)
+			}
+			i++
+		}
+		if it.Err() != nil || i != len(src.keys) {
+			t.Fatalf("iterated %d of %d records: %v", i, len(src.keys), it.Err())
+		}
+
+		// Every version is reachable by sequence number, wherever its block is
+		for i, key := range src.keys {
+			want := src.entries[i]
+			got, found, err := sst.searchAt(key, want.Seq)
+			if err != nil || !found || got.Seq != want.Seq || got.Tombstone != want.Tombstone || string(got.Value) != string(want.Value) {
+				t.Fatalf("searchAt(%s, %d) = %+v, %v, %v; want %+v", key, want.Seq, got, found, err, want)
+			}
+		}
+		if _, found, err := sst.Search("key00001"); found || err != nil {
+			t.Fatalf("found missing key: %v", err)
+		}
+
+		// Seek between keys lands on the newest version of the next one
+		it.Seek("key00003")
+		if !it.Valid() || it.Key() != "key00004" || string(it.Entry().Value) != "key00004-v2" {
+			t.Fatalf("Seek(key00003) landed on %s %q", it.Key(), it.Entry().Value)
+		}
+		if it.Seek("zzz"); it.Valid() {
+			t.Fatalf("Seek past the end landed on %s", it.Key())
+		}
+		it.Close()
+	}
+}
+
+func TestBlockRestartSeek(t *testing.T) {
+	b := newBlockBuilder(blockRestartInterval)
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("prefix/%03d", i*3)
+		keys = append(keys, key)
+		b.add(key, []byte{byte(i)})
+	}
+	blk, err := parseBlock(b.finish())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blk.numRestarts() != 100/blockRestartInterval+1 {
+		t.Fatalf("%d restart points", blk.numRestarts())
+	}
+	it := newBlockIter(blk)
+	for i := 0; i < 300; i++ {
+		target := fmt.Sprintf("prefix/%03d", i)
+		it.Seek(target)
+		if i > 297 {
+			if it.Valid() {
+				t.Fatalf("Seek(%s) past the last key landed on %s", target, it.key)
+			}
+			continue
+		}
+		want := keys[(i+2)/3]
+		if !it.Valid() || string(it.key) != want || it.payload[0] != byte((i+2)/3) {
+			t.Fatalf("Seek(%s) landed on %s, want %s", target, it.key, want)
+		}
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	rng.Read(random)
+	row := []byte(`{"id":42,"name":"alice","email":"alice@example.com","active":true}`)
+	inputs := map[string][]byte{
+		"empty":   nil,
+		"short":   []byte("abc"),
+		"random":  random,
+		"rows":    bytes.Repeat(row, 100),
+		"run":     bytes.Repeat([]byte{'x'}, 1000), // copies overlapping what they append
+		"literal": append(append([]byte{}, random[:300]...), bytes.Repeat(row, 3)...),
+	}
+	var enc snappyEncoder
+	for name, in := range inputs {
+		compressed := enc.encode(nil, in)
+		out, err := snappyDecode(compressed)
+		if err != nil || !bytes.Equal(out, in) {
+			t.Fatalf("%s: round trip failed: %v", name, err)
+		}
+		if name == "rows" && len(compressed) > len(in)/10 {
+			t.Fatalf("repeated rows compressed to %d of %d bytes", len(compressed), len(in))
+		}
+		// Truncations must be errors, never panics or wrong output
+		for cut := 1; cut < len(compressed); cut += 7 {
+			if out, err := snappyDecode(compressed[:cut]); err == nil && !bytes.Equal(out, in) {
+				t.Fatalf("%s: truncated at %d decoded to different bytes", name, cut)
+			}
+		}
+	}
+}
+
+// JSON rows compress well, and the stats show it.
+func TestRepositoryCompressesBlocks(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	for i := 0; i < 2000; i++ {
+		row := fmt.Sprintf(`{"id":%d,"name":"user %d","email":"user%d@example.com","active":true}`, i, i, i)
+		repo.put(fmt.Sprintf("r:shop:users:%05d", i), []byte(row))
+	}
+	repo.Flush()
+
+	stats := repo.CompressionStats()
+	if stats.Blocks == 0 || stats.CompressedBlocks != stats.Blocks || stats.Ratio() > 0.6 {
+		t.Fatalf("stats %+v, ratio %.2f", stats, stats.Ratio())
+	}
+	if v, _, _ := repo.Get("r:shop:users:01234"); !bytes.Contains(v, []byte(`"id":1234,`)) {
+		t.Fatalf("read back %q", v)
+	}
+}
+
+// flipByte damages one byte of a file in place.
+func flipByte(t *testing.T, filename string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A damaged block must fail the reads that reach it with ErrCorruption, never look like a missing key.
+func TestCorruptBlockIsReported(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := repo.CreateDatabase(ctx, "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateTable(ctx, "shop", benchUsers); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		row := domain.Row{fmt.Sprintf("%04d", i), fmt.Sprintf("user %d", i), fmt.Sprintf("user%d@example.com", i)}
+		if err := repo.InsertRow(ctx, "shop", "users", row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo.Flush()
+	sst := repo.sstables[0]
+	if len(sst.blocks) < 3 {
+		t.Fatalf("only %d blocks", len(sst.blocks))
+	}
+	damaged := sst.blocks[len(sst.blocks)/2].handle // rows only: the catalog entries are in the first and last blocks
+	repo.Close()
+	flipByte(t, sst.Filename, int64(damaged.offset+damaged.size/2))
+
+	// Without paranoid checks the table opens, and only reads of the damaged block fail
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := repo.GetRow(ctx, "shop", "users", "0000"); err != nil || !found {
+		t.Fatalf("row in an intact block: found=%v, %v", found, err)
+	}
+	_, err = repo.Query(ctx, "shop", "users")
+	var corruption *CorruptionError
+	if !errors.Is(err, ErrCorruption) || !errors.As(err, &corruption) {
+		t.Fatalf("Query over a damaged block returned %v", err)
+	}
+	if corruption.File != sst.Filename || corruption.Offset != int64(damaged.offset) {
+		t.Fatalf("corruption reported in %s at %d, want %s at %d", corruption.File, corruption.Offset, sst.Filename, damaged.offset)
+	}
+	repo.Close()
+
+	if _, err := NewLSMRepositoryWithOptions(dir, Options{ParanoidChecks: true}); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("paranoid open of a damaged table returned %v", err)
+	}
+}
+
+func TestCorruptIndexIsReported(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.put("a", []byte("1"))
+	repo.Flush()
+	filename := repo.sstables[0].Filename
+	repo.Close()
+
+	// Find the index block through the footer
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := f.Stat()
+	footer, ok, err := readBlockFooter(f, stat.Size())
+	f.Close()
+	if !ok || err != nil {
+		t.Fatalf("no footer: %v", err)
+	}
+	flipByte(t, filename, int64(footer.index.offset+footer.index.size/2))
+
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if _, found, err := repo.Get("a"); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Get through a damaged index = found %v, %v; want ErrCorruption", found, err)
+	}
+}
+
+// A footer whose lengths or handles are damaged, huge enough to wrap around when added up or
+// converted, is reported as corruption rather than read (or allocated) as given.
+func TestCorruptFooterIsReported(t *testing.T) {
+	dir := t.TempDir()
+
+	// A flat table: [Data][Filter][Index][filterLen u64][indexLen u64]
+	for name, lens := range map[string][2]uint64{
+		"filter": {0xFFFFFFFFFFFFFF00, 0},
+		"index":  {0, 0xFFFFFFFFFFFFFF00},
+		"both":   {1 << 63, 1 << 63},
+	} {
+		flat := make([]byte, 64+sstFooterSize)
+		binary.LittleEndian.PutUint64(flat[64:], lens[0])
+		binary.LittleEndian.PutUint64(flat[72:], lens[1])
+		filename := filepath.Join(dir, "flat_"+name+".db")
+		if err := os.WriteFile(filename, flat, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sst := &SSTable{Filename: filename, format: sstFormatLegacy}
+		if err := sst.LoadMetadata(); !errors.Is(err, ErrCorruption) {
+			t.Errorf("flat footer with %s length damaged: %v, want ErrCorruption", name, err)
+		}
+		sst.closeFile()
+	}
+
+	// A block table whose index handle wraps around: offset + size adds up to a small number
+	src := &sliceSource{keys: []string{"a"}, entries: []Entry{{Value: []byte("1"), Seq: 1}}}
+	filename := filepath.Join(dir, "sst_000001.db")
+	written, err := WriteSSTable(src, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written.closeFile()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := data[len(data)-blockFooterSize:]
+	offset := binary.LittleEndian.Uint64(footer[32:40])
+	binary.LittleEndian.PutUint64(footer[40:48], -offset)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sst := &SSTable{Filename: filename}
+	defer sst.closeFile()
+	if err := sst.LoadMetadata(); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("block footer with a wrapping index handle: %v, want ErrCorruption", err)
+	}
+}
+
+// The key range is in the file itself: a table opened without the MANIFEST's help knows it.
+func TestKeyRangeInFooter(t *testing.T) {
+	src := &sliceSource{}
+	for i := 0; i < 100; i++ {
+		src.keys = append(src.keys, fmt.Sprintf("key%03d", i))
+		src.entries = append(src.entries, Entry{Value: []byte("v"), Seq: uint64(i + 1)})
+	}
+	filename := filepath.Join(t.TempDir(), "sst_000001.db")
+	written, err := WriteSSTable(src, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written.closeFile()
+
+	sst := &SSTable{Filename: filename}
+	if err := sst.LoadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	defer sst.closeFile()
+	if !sst.keyRange || sst.SmallestKey != "key000" || sst.LargestKey != "key099" || sst.entries != 100 {
+		t.Fatalf("loaded range [%q, %q] (known: %v), %d entries", sst.SmallestKey, sst.LargestKey, sst.keyRange, sst.entries)
+	}
+	for key, want := range map[string]bool{"key000": true, "key050": true, "key099": true, "a": false, "key0999": false, "z": false} {
+		if got := sst.mayContainKey(key); got != want {
+			t.Errorf("mayContainKey(%s) = %v", key, got)
+		}
+	}
+	for _, r := range []struct {
+		lower, upper string
+		want         bool
+	}{{"", "", true}, {"", "key000", false}, {"", "key0000", true}, {"key099", "", true}, {"key0990", "", false}, {"a", "b", false}} {
+		if got := sst.mayOverlapRange(r.lower, r.upper); got != r.want {
+			t.Errorf("mayOverlapRange(%q, %q) = %v", r.lower, r.upper, got)
+		}
+	}
+
+	empty, err := decodeTableProperties(tableProperties{}.encode())
+	if err != nil || empty.hasKeys || empty.entries != 0 {
+		t.Fatalf("empty properties decoded as %+v, %v", empty, err)
+	}
+}
+
+// Lookups and scans outside a table's key range never read it: a damaged table only fails
+// the reads that fall in its range.
+func TestKeyRangeSkipsTables(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"a", "m", "z"} {
+		for i := 0; i < 50; i++ {
+			repo.put(fmt.Sprintf("%s%03d", prefix, i), []byte(prefix))
+		}
+		repo.Flush()
+	}
+	tables := repo.Tables()
+	if len(tables) != 3 {
+		t.Fatalf("%d tables listed", len(tables))
+	}
+	// Level 0, newest first
+	for i, prefix := range []string{"z", "m", "a"} {
+		tt := tables[i]
+		if tt.Level != 0 || tt.SmallestKey != prefix+"000" || tt.LargestKey != prefix+"049" || tt.Entries != 50 || tt.Size == 0 {
+			t.Fatalf("table %d: %+v", i, tt)
+		}
+	}
+	damaged := repo.sstables[2] // the "a" table
+	repo.Close()
+	flipByte(t, damaged.Filename, int64(damaged.blocks[0].handle.offset+1))
+
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if got := repo.Tables(); got[2].SmallestKey != "a000" || got[2].Entries != 50 {
+		t.Fatalf("after reopen: %+v", got[2])
+	}
+	if v, found, err := repo.Get("m010"); err != nil || !found || string(v) != "m" {
+		t.Fatalf("Get(m010) = %q, %v, %v", v, found, err)
+	}
+	it, err := repo.Range("m", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	if it.Err() != nil || n != 50 {
+		t.Fatalf("range scan: %d keys, %v", n, it.Err())
+	}
+	it.Close()
+	if _, _, err := repo.Get("a010"); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Get in the damaged table's range returned %v", err)
+	}
+
+	stats := repo.FilterStats()
+	// m010 skipped z (and was found before a), the scan skipped z and a, a010 skipped z and m
+	if stats[0].RangeSkips != 3 || stats[1].RangeSkips != 1 || stats[2].RangeSkips != 1 {
+		t.Fatalf("range skips %d, %d, %d", stats[0].RangeSkips, stats[1].RangeSkips, stats[2].RangeSkips)
+	}
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrTxnConflict is returned by Commit when another write changed a key the transaction writes.
+	ErrTxnConflict = errors.New("transaction conflict")
+	// ErrTxnDone is returned when a transaction is used after Commit or Rollback.
+	ErrTxnDone = errors.New("transaction already committed or rolled back")
+)
+
+// Txn is an optimistic transaction: it reads from a snapshot taken at Begin, buffers its
+// writes in memory, and only touches the tree at Commit.
+//
+//	txn := repo.Begin()
+//	defer txn.Rollback() // no-op after a successful Commit
+//	txn.InsertRow(ctx, "shop", "users", row)
+//	err := txn.Commit() // errors.Is(err, ErrTxnConflict) -> retry the whole transaction
+//
+// Reads see the snapshot plus the transaction's own writes (Get, Scan and the Repository
+// methods alike). Nothing is locked while it runs: at Commit, if any key it writes got a
+// newer version after the snapshot was taken, the commit fails and nothing is written
+// (first committer wins). Otherwise all its writes go in as one WriteBatch.
+//
+// Only write-write conflicts are detected (snapshot isolation), and only between
+// transactions: a plain repo.Write racing a Commit is not checked, the higher sequence
+// number wins as usual. A Txn is not safe for concurrent use.
+type Txn struct {
+	catalog // Repository methods, running on the transaction's view
+
+	repo    *LSMRepository
+	snap    *Snapshot
+	pending *MemTable   // Our writes, for our own reads
+	batch   *WriteBatch // Our writes, in order, for Commit
+	done    bool
+}
+
+// Compile-time check: a transaction can stand in for the repository.
+var _ Repository = (*Txn)(nil)
+
+// Begin starts a transaction on the current state of the database.
+func (r *LSMRepository) Begin() *Txn {
+	t := &Txn{
+		repo:    r,
+		snap:    r.NewSnapshot(),
+		pending: NewMemTable(),
+		batch:   NewWriteBatch(),
+	}
+	t.catalog.kv = t
+	return t
+}
+
+// Get is a point lookup on a raw key: our own writes first, then the snapshot.
+func (t *Txn) Get(key string) ([]byte, bool, error) {
+	if t.done {
+		return nil, false, ErrTxnDone
+	}
+	if entry, ok := t.pending.Get(key); ok {
+		return entry.Value, !entry.Tombstone, nil
+	}
+	return t.snap.Get(key)
+}
+
+// Scan returns an iterator over every key starting with prefix, our own writes included.
+func (t *Txn) Scan(prefix string) (Iterator, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	// Staged entries carry the snapshot's sequence number, so the iterator shows them and
+	// they shadow whatever version of the key the snapshot has
+	it, err := t.repo.newIterator(prefix, prefixEnd(prefix), t.snap.seq, t.pending)
+	if err != nil {
+		return nil, err
+	}
+	it.Seek(prefix)
+	return it, nil
+}
+
+// Write buffers the batch; it reaches the WAL only when the transaction commits.
+func (t *Txn) Write(b *WriteBatch) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.pending.stage(b, t.snap.seq)
+	t.batch.ops = append(t.batch.ops, b.ops...)
+	t.batch.size += b.size
+	return nil
+}
+
+// Commit checks for conflicts and writes everything atomically. The transaction is over
+// either way: on error nothing was written.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	// Keep the snapshot until the check is done, so compaction can't drop the versions it looks for
+	defer t.snap.Release()
+
+	if t.batch.Len() == 0 {
+		return nil
+	}
+
+	r := t.repo
+	// One commit at a time: between our check and our write no other transaction may sneak in
+	r.commitMu.Lock()
+	defer r.commitMu.Unlock()
+
+	for _, op := range t.batch.ops {
+		newest, found, err := r.lookup(op.key, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		if found && newest.Seq > t.snap.seq {
+			return fmt.Errorf("%w: %q was written at seq %d, after our snapshot at %d", ErrTxnConflict, op.key, newest.Seq, t.snap.seq)
+		}
+	}
+	return r.Write(t.batch)
+}
+
+// Rollback throws the buffered writes away. Calling it after Commit (or twice) is harmless.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.snap.Release()
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"chill-db/internal/domain"
+)
+
+func TestTxnReadsOwnWritesInIsolation(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	repo.put("a", []byte("1"))
+	repo.put("b", []byte("1"))
+	repo.Flush()
+
+	txn := repo.Begin()
+	defer txn.Rollback()
+	txn.set("a", []byte("2"))
+	txn.remove("b")
+	txn.set("c", []byte("2"))
+
+	// Someone else writes after our snapshot: we don't see it
+	repo.put("d", []byte("3"))
+
+	if v, _, _ := txn.Get("a"); string(v) != "2" {
+		t.Fatalf("txn Get(a) = %q, want our own write", v)
+	}
+	got, err := drain(txn.Scan(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a=2", "c=2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("txn scan = %v, want %v", got, want)
+	}
+	// ...and nobody sees ours before Commit
+	if got, _ := drain(repo.Scan("")); !reflect.DeepEqual(got, []string{"a=1", "b=1", "d=3"}) {
+		t.Fatalf("uncommitted writes leaked: %v", got)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := drain(repo.Scan("")); !reflect.DeepEqual(got, []string{"a=2", "c=2", "d=3"}) {
+		t.Fatalf("after commit: %v", got)
+	}
+	if err := txn.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("second Commit = %v, want ErrTxnDone", err)
+	}
+}
+
+func TestTxnWriteWriteConflict(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	repo.put("k", []byte("0"))
+	first, second := repo.Begin(), repo.Begin()
+	first.set("k", []byte("first"))
+	second.set("k", []byte("second"))
+	second.set("other", []byte("second"))
+
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Commit(); !errors.Is(err, ErrTxnConflict) {
+		t.Fatalf("second Commit = %v, want ErrTxnConflict", err)
+	}
+	// The loser wrote nothing, not even its non-conflicting key
+	if v, _, _ := repo.Get("k"); string(v) != "first" {
+		t.Fatalf("k = %q, want first", v)
+	}
+	if _, found, _ := repo.Get("other"); found {
+		t.Fatal("aborted transaction left a write behind")
+	}
+
+	// Disjoint keys don't conflict
+	a, b := repo.Begin(), repo.Begin()
+	a.set("x", []byte("a"))
+	b.set("y", []byte("b"))
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("disjoint commit: %v", err)
+	}
+}
+
+func TestTxnRollbackDiscardsCatalogChanges(t *testing.T) {
+	repo, err := NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	ctx := context.Background()
+
+	repo.CreateDatabase(ctx, "shop")
+	repo.CreateTable(ctx, "shop", domain.TableMetaData{Name: "users", Columns: []domain.ColumnDefinition{{Name: "id", Type: "int"}}})
+
+	txn := repo.Begin()
+	if err := txn.InsertRows(ctx, "shop", "users", []domain.Row{{"1"}, {"2"}}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := txn.Query(ctx, "shop", "users")
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("txn Query = %v, %v; want 2 rows", rows, err)
+	}
+	txn.Rollback()
+
+	if rows, _ := repo.Query(ctx, "shop", "users"); len(rows) != 0 {
+		t.Fatalf("rolled back rows visible: %v", rows)
+	}
+	if err := txn.InsertRow(ctx, "shop", "users", domain.Row{"3"}); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("InsertRow after Rollback = %v, want ErrTxnDone", err)
+	}
+}
@@ -3,22 +3,99 @@ package db
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Before we touch the MemTable, we write the operation to a file on disk.
 // Speed: We only append to the end of the file. Appending is extremely fast (almost as fast as RAM) because the disk head doesn't have to jump around.
 // Recovery: If we crash, we just read this file from top to bottom on restart to rebuild the MemTable.
+//
+// Record layout:
+//
+//	[crc uint32][length uint32][payload (length bytes)]
+//	payload = [seq uint64][count uint32] then count x [keyLen int32][valLen int32][key][value]   (valLen = -1 for a tombstone)
+//
+// Every record is a WriteBatch (a single Put is a batch of one), so a multi-key batch is
+// durable as a unit: its record is either intact or thrown away whole.
+//
+// The CRC (Castagnoli) covers length + payload. A crash in the middle of a write leaves a
+// record whose length runs past the end of the file, or whose CRC doesn't match: recovery
+// stops there, keeps everything before it and truncates the rest.
 
+const walHeaderSize = 8
+
+// walMaxRecord guards against a corrupt length field asking us to allocate gigabytes.
+const walMaxRecord = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errWALTorn    = errors.New("torn record")
+	errWALCorrupt = errors.New("checksum mismatch")
+)
+
+// SyncMode decides when appended records are fsync'ed to disk.
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs every commit group before any of its writers return (the default).
+	SyncAlways SyncMode = iota
+	// SyncInterval returns once the group is in the OS page cache and fsyncs in the background
+	// every Options.SyncInterval: a power cut can lose up to one interval of writes, a process crash can't.
+	SyncInterval
+	// SyncNone never fsyncs (except on Close) and leaves it to the OS.
+	SyncNone
+)
+
+// walMaxGroup caps how many bytes one leader commits at once, so a huge queue can't make the
+// first writer wait on everybody else's data.
+const walMaxGroup = 1 << 20
+
+var errWALClosed = errors.New("wal is closed")
+
+// walWriter is one pending Append waiting in the commit queue.
+type walWriter struct {
+	payload []byte
+	done    bool
+	err     error
+}
+
+// Group commit: writers queue up under mu. The writer at the head of the queue becomes the
+// leader, takes everything queued so far, and writes it with ONE write + ONE fsync while the
+// others wait; then it wakes them all with the shared result. Writers that arrive meanwhile
+// form the next group. Under load that turns N fsyncs into 1.
 type WAL struct {
-	file   *os.File
-	path   string
-	writer *bufio.Writer
+	file *os.File
+	path string
+	mode SyncMode
+
 	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*walWriter
+	buf    []byte // reused by the leader to build the group
+	err    error  // sticky: after a failed write the tail of the file is suspect
+	closed bool
+
+	stopSync chan struct{} // stops the SyncInterval goroutine
+	syncDone chan struct{}
+
+	groups  atomic.Int64 // commit groups written (one write syscall each)
+	syncs   atomic.Int64 // fsync calls
+	records atomic.Int64 // records appended
 }
 
 func NewWAL(path string) (*WAL, error) {
+	return NewWALWithSync(path, SyncAlways, 0)
+}
+
+func NewWALWithSync(path string, mode SyncMode, interval time.Duration) (*WAL, error) {
 	// O_APPEND: Always write to the end
 	// O_CREATE: Create if it doesn't exist
 	// O_WRONLY: We only write here (reading is for recovery startup)
@@ -26,64 +103,226 @@ func NewWAL(path string) (*WAL, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &WAL{file: f, path: path, writer: bufio.NewWriterSize(f, 4096)}, nil
+	w := &WAL{file: f, path: path, mode: mode}
+	w.cond = sync.NewCond(&w.mu)
+
+	if mode == SyncInterval {
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		w.stopSync = make(chan struct{})
+		w.syncDone = make(chan struct{})
+		go w.syncLoop(interval)
+	}
+	return w, nil
 }
-func (w *WAL) Truncate() error {
+
+func (w *WAL) syncLoop(interval time.Duration) {
+	defer close(w.syncDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopSync:
+			return
+		case <-ticker.C:
+			// os.File is safe to Sync while the leader is writing
+			if err := w.file.Sync(); err != nil {
+				w.mu.Lock()
+				if w.err == nil {
+					w.err = err
+				}
+				w.mu.Unlock()
+				return
+			}
+			w.syncs.Add(1)
+		}
+	}
+}
+
+func (w *WAL) Append(key string, value []byte) error {
+	b := NewWriteBatch()
+	b.Put(key, value)
+	return w.AppendBatch(b)
+}
+
+// AppendBatch logs every operation of b as one record.
+func (w *WAL) AppendBatch(b *WriteBatch) error {
+	return w.append(b.encode())
+}
+
+func (w *WAL) append(payload []byte) error {
+	me := &walWriter{payload: payload}
+
 	w.mu.Lock()
-	defer w.mu.Unlock()
-	// 1. Close the current file handle
-	if err := w.file.Close(); err != nil {
-		return err
+	if w.closed {
+		w.mu.Unlock()
+		return errWALClosed
+	}
+	w.queue = append(w.queue, me)
+	for !me.done && w.queue[0] != me {
+		w.cond.Wait()
+	}
+	if me.done {
+		// A leader committed our record for us
+		w.mu.Unlock()
+		return me.err
 	}
 
-	// 2. Wipe the file content using the path we saved
-	if err := os.Truncate(w.path, 0); err != nil {
-		return err
+	// We are the leader: take the group, then write it without holding mu so the
+	// next group can queue up behind us.
+	group, size := 1, len(payload)
+	for group < len(w.queue) && size+len(w.queue[group].payload) <= walMaxGroup {
+		size += len(w.queue[group].payload)
+		group++
 	}
+	batch := w.queue[:group]
+	err := w.err
+	w.mu.Unlock()
 
-	// 3. Re-open the file for appending
-	var err error
-	w.file, err = os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	if err == nil {
+		err = w.writeGroup(batch)
+	}
+
+	w.mu.Lock()
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	for _, writer := range batch {
+		writer.done, writer.err = true, err
+	}
+	w.queue = w.queue[group:]
+	w.cond.Broadcast() // wake the followers, and the next leader
+	w.mu.Unlock()
+	return err
+}
+
+// writeGroup frames every record of the group into one buffer: one write, then one fsync.
+func (w *WAL) writeGroup(batch []*walWriter) error {
+	w.buf = w.buf[:0]
+	for _, writer := range batch {
+		w.buf = appendRecord(w.buf, writer.payload)
+	}
+
+	// Push the group to the OS Kernel (1 System Call)
+	if _, err := w.file.Write(w.buf); err != nil {
 		return err
 	}
-	w.writer.Reset(w.file)
+	w.groups.Add(1)
+	w.records.Add(int64(len(batch)))
+
+	// (2 System Call) only if the policy wants durability before returning
+	if w.mode == SyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.syncs.Add(1)
+	}
 	return nil
 }
 
-func (w *WAL) Append(key string, value []byte) error {
+// appendRecord frames payload as [crc][length][payload] onto buf. The MANIFEST uses the same framing.
+func appendRecord(buf, payload []byte) []byte {
+	// Why binary.LittleEndian? Computers store numbers in different ways (big-endian vs little-endian). We choose one standard so that if you move the file to a different computer, it can still be read.
+	// Why uint32? We use a fixed size (4 bytes) for the length so the reader knows exactly how many bytes to read next.
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
+	crc := crc32.Update(0, crcTable, header[4:8])
+	crc = crc32.Update(crc, crcTable, payload)
+	binary.LittleEndian.PutUint32(header[0:4], crc)
+
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// Close waits for queued writers, fsyncs whatever the policy left unsynced, and closes the file.
+func (w *WAL) Close() error {
 	w.mu.Lock()
-	defer w.mu.Unlock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	for len(w.queue) > 0 {
+		w.cond.Wait()
+	}
+	w.mu.Unlock()
 
-	err := binary.Write(w.writer, binary.LittleEndian, int32(len(key))) // Why binary.LittleEndian? Computers store numbers in different ways (big-endian vs little-endian). We choose one standard so that if you move the file to a different computer, it can still be read.
-	if err != nil {
-		return err
+	if w.stopSync != nil {
+		close(w.stopSync)
+		<-w.syncDone
 	}
-	err = binary.Write(w.writer, binary.LittleEndian, int32(len(value))) // Why int32? We use a fixed size (4 bytes) for the length so the reader knows exactly how many bytes to read next.
-	if err != nil {
+	syncErr := w.file.Sync()
+	if err := w.file.Close(); err != nil {
 		return err
 	}
-	_, err = w.writer.WriteString(key)
-	if err != nil {
-		return err
+	return syncErr
+}
+
+// walReader decodes records one by one and remembers where the last good one ended.
+type walReader struct {
+	r      *bufio.Reader
+	offset int64 // end of the last record that decoded cleanly
+	buf    []byte
+}
+
+func newWALReader(r io.Reader) *walReader {
+	return &walReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// next returns the next payload, io.EOF at a clean end of file, or errWALTorn/errWALCorrupt.
+func (wr *walReader) next() ([]byte, error) {
+	var header [walHeaderSize]byte
+	n, err := io.ReadFull(wr.r, header[:])
+	if err == io.EOF {
+		return nil, io.EOF
 	}
-	_, err = w.writer.Write(value)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %d-byte header", errWALTorn, n)
 	}
-	//FLUSH: Push the buffer to the OS Kernel (1 System Call)
-	if err := w.writer.Flush(); err != nil {
-		return err
+
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length > walMaxRecord {
+		return nil, fmt.Errorf("%w: implausible length %d", errWALCorrupt, length)
 	}
-	// (2 System Call)
-	if err := w.file.Sync(); err != nil {
-		return err
+	if cap(wr.buf) < int(length) {
+		wr.buf = make([]byte, length)
 	}
-	return nil
+	payload := wr.buf[:length]
+	if _, err := io.ReadFull(wr.r, payload); err != nil {
+		return nil, fmt.Errorf("%w: payload cut short", errWALTorn)
+	}
+
+	crc := crc32.Update(0, crcTable, header[4:8])
+	crc = crc32.Update(crc, crcTable, payload)
+	if crc != binary.LittleEndian.Uint32(header[0:4]) {
+		return nil, errWALCorrupt
+	}
+	wr.offset += walHeaderSize + int64(length)
+	return payload, nil
 }
 
-func (w *WAL) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	return w.file.Close()
+// countRemaining is used after a bad record: it walks the rest of the file by length fields
+// alone to estimate how many records are being thrown away (at least the bad one).
+func (wr *walReader) countRemaining() int {
+	return 1 + wr.countRecords()
+}
+
+// countRecords walks the rest of the file by length fields alone and counts the records.
+func (wr *walReader) countRecords() int {
+	count := 0
+	for {
+		var header [walHeaderSize]byte
+		if _, err := io.ReadFull(wr.r, header[:]); err != nil {
+			return count
+		}
+		length := binary.LittleEndian.Uint32(header[4:8])
+		if length > walMaxRecord {
+			return count
+		}
+		if _, err := wr.r.Discard(int(length)); err != nil {
+			return count
+		}
+		count++
+	}
 }
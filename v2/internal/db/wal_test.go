@@ -0,0 +1,243 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeSegment writes keys k0..kN-1 through a real WAL and returns the segment path and record size.
+func writeSegment(t *testing.T, dir string, n int) (string, int64) {
+	t.Helper()
+	path := filepath.Join(dir, "wal_000001.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := wal.Append(string(rune('a'+i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.Close()
+	// header + batch header + op header + 1-byte key + value
+	return path, int64(walHeaderSize + batchHeaderSize + 8 + 1 + len("value"))
+}
+
+func TestWALRecoveryTornTail(t *testing.T) {
+	dir := t.TempDir()
+	path, recLen := writeSegment(t, dir, 4)
+
+	// Simulate a crash halfway through the 4th record
+	if err := os.Truncate(path, 3*recLen+5); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatalf("a torn tail must not fail the open: %v", err)
+	}
+	defer repo.Close()
+
+	got := repo.RecoveryReport()
+	want := RecoveryReport{Segments: 1, Recovered: 3, Discarded: 1, TruncatedBytes: 5}
+	if got != want {
+		t.Fatalf("report = %+v, want %+v", got, want)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if _, found, _ := repo.Get(k); !found {
+			t.Fatalf("%s lost", k)
+		}
+	}
+	if _, found, _ := repo.Get("d"); found {
+		t.Fatal("torn record was applied")
+	}
+}
+
+func TestWALRecoveryChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	path, recLen := writeSegment(t, dir, 3)
+
+	// Flip one bit in the second record's value
+	data, _ := os.ReadFile(path)
+	data[recLen+recLen-1] ^= 0x01
+	os.WriteFile(path, data, 0644)
+
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	got := repo.RecoveryReport()
+	want := RecoveryReport{Segments: 1, Recovered: 1, Discarded: 2, TruncatedBytes: 2 * recLen}
+	if got != want {
+		t.Fatalf("report = %+v, want %+v", got, want)
+	}
+	// Recovery stops at the first bad record: "c" is intact but comes after it
+	if _, found, _ := repo.Get("c"); found {
+		t.Fatal("records after a corrupt one must not be applied")
+	}
+}
+
+// A segment whose tail was lost (never synced before the rotation) must not let the next
+// segment's writes come back without it: recovery stops there, later segments included.
+func TestWALRecoveryStopsAtDamagedSegment(t *testing.T) {
+	dir := t.TempDir()
+	path, recLen := writeSegment(t, dir, 3)
+	if err := os.Truncate(path, 2*recLen+5); err != nil {
+		t.Fatal(err)
+	}
+	for num, keys := range map[int][]string{2: {"d", "e"}, 3: {"f"}} {
+		wal, err := NewWAL(filepath.Join(dir, fmt.Sprintf("wal_%06d.log", num)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := wal.Append(k, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wal.Close()
+	}
+
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	got := repo.RecoveryReport()
+	want := RecoveryReport{Segments: 3, Recovered: 2, Discarded: 4, TruncatedBytes: 5}
+	if got != want {
+		t.Fatalf("report = %+v, want %+v", got, want)
+	}
+	for _, k := range []string{"c", "d", "e", "f"} {
+		if _, found, _ := repo.Get(k); found {
+			t.Fatalf("%s came back past the damaged segment", k)
+		}
+	}
+}
+
+func TestWALRecoveryLegacyFormat(t *testing.T) {
+	dir := t.TempDir()
+	// Pre-checksum wal.log: [keyLen int32][valLen int32][key][value]
+	legacy := []byte{3, 0, 0, 0, 2, 0, 0, 0, 'k', 'e', 'y', 'o', 'k'}
+	os.WriteFile(filepath.Join(dir, "wal.log"), legacy, 0644)
+
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if val, found, _ := repo.Get("key"); !found || string(val) != "ok" {
+		t.Fatalf("legacy record not replayed: %q %v", val, found)
+	}
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncInterval, SyncNone} {
+		dir := t.TempDir()
+		wal, err := NewWALWithSync(filepath.Join(dir, "wal_000001.log"), mode, 5*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const writers, perWriter = 16, 50
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < perWriter; i++ {
+					if err := wal.Append(fmt.Sprintf("w%02d-%03d", w, i), []byte("v")); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		if got := wal.records.Load(); got != writers*perWriter {
+			t.Fatalf("mode %d: %d records, want %d", mode, got, writers*perWriter)
+		}
+		if mode == SyncAlways && wal.syncs.Load() != wal.groups.Load() {
+			t.Fatalf("SyncAlways must fsync every group: %d syncs for %d groups", wal.syncs.Load(), wal.groups.Load())
+		}
+		if mode == SyncNone && wal.syncs.Load() != 0 {
+			t.Fatalf("SyncNone fsynced %d times", wal.syncs.Load())
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := wal.Append("late", nil); err == nil {
+			t.Fatal("Append after Close must fail")
+		}
+
+		// Every record made it to the file intact, whatever the grouping
+		repo, err := NewLSMRepository(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := repo.RecoveryReport(); got.Recovered != writers*perWriter || got.Discarded != 0 {
+			t.Fatalf("mode %d: recovery %+v", mode, got)
+		}
+		repo.Close()
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	cases := []struct {
+		in       string
+		mode     SyncMode
+		interval time.Duration
+	}{
+		{"always", SyncAlways, 0},
+		{"none", SyncNone, 0},
+		{"50ms", SyncInterval, 50 * time.Millisecond},
+		{"every 2s", SyncInterval, 2 * time.Second},
+	}
+	for _, c := range cases {
+		mode, interval, err := ParseSyncPolicy(c.in)
+		if err != nil || mode != c.mode || interval != c.interval {
+			t.Errorf("ParseSyncPolicy(%q) = %v, %v, %v", c.in, mode, interval, err)
+		}
+	}
+	if _, _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+// Sequence numbers are logged with every batch and survive a replay, flush and reopen.
+func TestSequenceNumbersSurviveRecovery(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.put("a", []byte("1"))
+	repo.put("b", []byte("2"))
+	repo.put("a", []byte("3"))
+	repo.Close() // not flushed: everything comes back from the WAL
+
+	repo, err = NewLSMRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	entry, found, err := repo.sstables[0].Search("a")
+	if err != nil || !found || string(entry.Value) != "3" || entry.Seq != 3 {
+		t.Fatalf("a = %+v, %v, %v; want value 3 at seq 3", entry, found, err)
+	}
+	if got := repo.lastSeq.Load(); got != 3 {
+		t.Fatalf("lastSeq = %d after recovery, want 3", got)
+	}
+	repo.put("c", []byte("4"))
+	if smallest, _ := repo.memTable.seqRange(); smallest != 4 {
+		t.Fatalf("first write after reopen got seq %d, want 4", smallest)
+	}
+}
@@ -12,8 +12,86 @@ import (
 )
 
 
+// Execute runs one statement, or several separated by ';'. Several statements can form a
+// transaction (engines that support it, see db.TxRepository):
+//
+//	BEGIN; INSERT INTO a VALUES (1, 'x'); INSERT INTO b VALUES (1, 'y'); COMMIT
+//
+// Each request is its own session, so a transaction must end in the same request it began.
+// If a statement fails or COMMIT is missing, everything since BEGIN is rolled back.
 func Execute(ctx context.Context, repo db.Repository, dbName, query string) (string, error) {
-	query = strings.TrimSpace(query)
+	statements, err := splitStatements(query)
+	if err != nil {
+		return "", err
+	}
+	if len(statements) == 0 {
+		return "", fmt.Errorf("empty query")
+	}
+
+	var txn *db.Txn
+	defer func() {
+		if txn != nil {
+			txn.Rollback()
+		}
+	}()
+
+	var results []string
+	for _, stmt := range statements {
+		switch strings.Join(strings.Fields(strings.ToUpper(stmt)), " ") {
+		case "BEGIN", "BEGIN TRANSACTION", "START TRANSACTION":
+			if txn != nil {
+				return "", fmt.Errorf("transaction already in progress")
+			}
+			txRepo, ok := repo.(db.TxRepository)
+			if !ok {
+				return "", fmt.Errorf("transactions are not supported by this storage engine")
+			}
+			txn = txRepo.Begin()
+			results = append(results, "Transaction started.")
+		case "COMMIT":
+			if txn == nil {
+				return "", fmt.Errorf("COMMIT without BEGIN")
+			}
+			err := txn.Commit()
+			txn = nil
+			if err != nil {
+				return "", err
+			}
+			results = append(results, "Transaction committed.")
+		case "ROLLBACK":
+			if txn == nil {
+				return "", fmt.Errorf("ROLLBACK without BEGIN")
+			}
+			txn.Rollback()
+			txn = nil
+			results = append(results, "Transaction rolled back.")
+		default:
+			// Inside a transaction statements read and write through it
+			target := repo
+			if txn != nil {
+				target = txn
+			}
+			result, err := executeStatement(ctx, target, dbName, stmt)
+			if err != nil {
+				return "", err
+			}
+			results = append(results, result)
+		}
+	}
+
+	if txn != nil {
+		return "", fmt.Errorf("transaction not committed: end it with COMMIT or ROLLBACK in the same request")
+	}
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	for i := range results {
+		results[i] = strings.TrimSuffix(results[i], "\n")
+	}
+	return strings.Join(results, "\n"), nil
+}
+
+func executeStatement(ctx context.Context, repo db.Repository, dbName, query string) (string, error) {
 	upperQuery := strings.ToUpper(query)
 
 	switch {
@@ -28,6 +106,40 @@ func Execute(ctx context.Context, repo db.Repository, dbName, query string) (str
 	}
 }
 
+// splitStatements splits a query on ';' into trimmed, non-empty statements.
+// A ';' inside quotes is part of the value.
+func splitStatements(query string) ([]string, error) {
+	var statements []string
+	var stmt strings.Builder
+	var quote rune
+
+	flush := func() {
+		if s := strings.TrimSpace(stmt.String()); s != "" {
+			statements = append(statements, s)
+		}
+		stmt.Reset()
+	}
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ';':
+			flush()
+			continue
+		}
+		stmt.WriteRune(c)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("syntax error: unterminated quote")
+	}
+	flush()
+	return statements, nil
+}
+
 
 // parseCreate: "CREATE TABLE users (id int, name string)"
 func parseCreate(ctx context.Context, repo db.Repository, dbName, query string) (string, error) {
@@ -60,28 +172,85 @@ func parseCreate(ctx context.Context, repo db.Repository, dbName, query string)
 }
 
 // parseInsert: "INSERT INTO users VALUES ('1', 'john')"
+// Several rows at once: "INSERT INTO users VALUES ('1', 'john'), ('2', 'jane')" -> all or nothing
 func parseInsert(ctx context.Context, repo db.Repository, dbName, query string) (string, error) {
-	re := regexp.MustCompile(`(?i)^INSERT\s+INTO\s+(\w+)\s+VALUES\s*\((.+)\)$`)
+	re := regexp.MustCompile(`(?i)^INSERT\s+INTO\s+(\w+)\s+VALUES\s*(\(.+\))$`)
 	matches := re.FindStringSubmatch(query)
 	if len(matches) < 3 {
-		return "", fmt.Errorf("syntax error: INSERT INTO <table> VALUES (<values>)")
+		return "", fmt.Errorf("syntax error: INSERT INTO <table> VALUES (<values>)[, (<values>)...]")
 	}
 
 	tableName := matches[1]
-	rawValues := strings.Split(matches[2], ",")
-	
-	var row domain.Row
-	for _, val := range rawValues {
-		// Clean up quotes: 'john' -> john
-		clean := strings.TrimSpace(val)
-		clean = strings.Trim(clean, "'\"")
-		row = append(row, clean)
+	rows, err := parseValueTuples(matches[2])
+	if err != nil {
+		return "", err
 	}
 
-	if err := repo.InsertRow(ctx, dbName, tableName, row); err != nil {
+	if err := repo.InsertRows(ctx, dbName, tableName, rows); err != nil {
 		return "", err
 	}
-	return "Row inserted.", nil
+	if len(rows) == 1 {
+		return "Row inserted.", nil
+	}
+	return fmt.Sprintf("%d rows inserted.", len(rows)), nil
+}
+
+// parseValueTuples splits "(1, 'a'), (2, 'b,c')" into rows.
+// Commas and parentheses inside quotes are part of the value.
+// An empty list "()" or an empty first value (the primary key) is rejected.
+func parseValueTuples(input string) ([]domain.Row, error) {
+	var rows []domain.Row
+	var row domain.Row
+	var val strings.Builder
+	var quote rune // the quote we are inside, 0 if none
+	inTuple := false
+	empty := true // nothing but blanks in the current list so far
+
+	for _, c := range input {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				val.WriteRune(c)
+			}
+		case !inTuple:
+			// Between tuples only separators are allowed
+			if c == '(' {
+				inTuple, empty = true, true
+			} else if c != ',' && c != ' ' && c != '\t' && c != '\n' {
+				return nil, fmt.Errorf("syntax error: unexpected %q between value lists", c)
+			}
+		case c == '\'' || c == '"':
+			quote, empty = c, false
+		case c == ',':
+			empty = false
+			row = append(row, strings.TrimSpace(val.String()))
+			val.Reset()
+		case c == ')':
+			if empty {
+				return nil, fmt.Errorf("syntax error: empty value list in row %d", len(rows)+1)
+			}
+			row = append(row, strings.TrimSpace(val.String()))
+			val.Reset()
+			if row[0] == "" {
+				return nil, fmt.Errorf("syntax error: empty primary key (the first value) in row %d", len(rows)+1)
+			}
+			rows = append(rows, row)
+			row = nil
+			inTuple = false
+		default:
+			val.WriteRune(c)
+			if c != ' ' && c != '\t' && c != '\n' {
+				empty = false
+			}
+		}
+	}
+
+	if quote != 0 || inTuple {
+		return nil, fmt.Errorf("syntax error: unterminated value list")
+	}
+	return rows, nil
 }
 
 // parseSelect: "SELECT * FROM users"
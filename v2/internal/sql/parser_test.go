@@ -0,0 +1,27 @@
+package sql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"chill-db/internal/domain"
+)
+
+func TestParseValueTuples(t *testing.T) {
+	rows, err := parseValueTuples("(1, alice), ('2', 'bob, jr' ), (3, '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []domain.Row{{"1", "alice"}, {"2", "bob, jr"}, {"3", ""}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("rows = %q, want %q", rows, want)
+	}
+
+	// Every row needs a primary key: an empty list would be stored under an empty one
+	for _, input := range []string{"()", "( )", "(1), ()", "('')", "(, 'a')", "(1, 'a'), ('  ', 'b')"} {
+		if rows, err := parseValueTuples(input); err == nil || !strings.Contains(err.Error(), "syntax error") {
+			t.Errorf("%s parsed as %q, %v; want a syntax error", input, rows, err)
+		}
+	}
+}
@@ -36,13 +36,24 @@ func TestSQLIntegration(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create repo: %v", err)
 	}
+	runSQLIntegration(t, repo)
+}
+
+// Same flow, backed by the LSM engine instead of CSV files.
+func TestSQLIntegrationLSM(t *testing.T) {
+	repo, err := db.NewLSMRepository(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create repo: %v", err)
+	}
+	defer repo.Close()
+	runSQLIntegration(t, repo)
+}
+
+func runSQLIntegration(t *testing.T, repo db.Repository) {
 	handler := api.NewHandler(repo)
 
-	// 3. ROUTER: Recreate the server routing logic
-	mux := http.NewServeMux()
-	mux.HandleFunc("/database/create", handler.CreateDatabase)
-	mux.HandleFunc("/sql", handler.HandleSQL)
-	// Add other routes if needed, e.g., /databases
+	// 3. ROUTER: The same routes cmd/server serves
+	mux := handler.Routes()
 
 	// 4. HELPER: A function to reduce code repetition
 	sendRequest := func(method, target string, body interface{}) *httptest.ResponseRecorder {
@@ -95,6 +106,52 @@ func TestSQLIntegration(t *testing.T) {
 		}
 	})
 
+	// --- STEP 3b: Insert Several Rows At Once ---
+	t.Run("3b. Insert Multiple Rows", func(t *testing.T) {
+		req := SQLRequest{
+			DBName: "integration_test_db",
+			Query:  "INSERT INTO users VALUES (2, 'bob', 25), (3, 'carol, jr', 41)",
+		}
+		resp := sendRequest("POST", "/sql", req)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Failed to insert rows. Code: %d, Body: %s", resp.Code, resp.Body.String())
+		}
+		if !strings.Contains(resp.Body.String(), "2 rows inserted") {
+			t.Errorf("Expected '2 rows inserted', got: %s", resp.Body.String())
+		}
+	})
+
+	// --- STEP 3c: Transactions (all or nothing) ---
+	_, txSupported := repo.(db.TxRepository)
+	t.Run("3c. Transaction", func(t *testing.T) {
+		req := SQLRequest{
+			DBName: "integration_test_db",
+			Query:  "BEGIN; INSERT INTO users VALUES (4, 'dave', 50); INSERT INTO users VALUES (5, 'erin', 22); COMMIT",
+		}
+		resp := sendRequest("POST", "/sql", req)
+
+		if !txSupported {
+			if resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "not supported") {
+				t.Fatalf("Expected transactions to be rejected. Code: %d, Body: %s", resp.Code, resp.Body.String())
+			}
+			return
+		}
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Transaction failed. Code: %d, Body: %s", resp.Code, resp.Body.String())
+		}
+		if !strings.Contains(resp.Body.String(), "Transaction committed.") {
+			t.Errorf("Expected 'Transaction committed.', got: %s", resp.Body.String())
+		}
+
+		// A failing statement rolls back the rows inserted before it
+		req.Query = "BEGIN; INSERT INTO users VALUES (6, 'frank', 60); INSERT INTO missing VALUES (1); COMMIT"
+		resp = sendRequest("POST", "/sql", req)
+		if resp.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected the transaction to fail. Code: %d, Body: %s", resp.Code, resp.Body.String())
+		}
+	})
+
 	// --- STEP 4: Select Data ---
 	t.Run("4. Select Data", func(t *testing.T) {
 		req := SQLRequest{
@@ -108,8 +165,43 @@ func TestSQLIntegration(t *testing.T) {
 		}
 
 		// Validation: Ensure the data we inserted actually came back
-		if !strings.Contains(resp.Body.String(), "alice") {
-			t.Errorf("Expected response to contain 'alice', got: %s", resp.Body.String())
+		names := []string{"alice", "bob", "carol, jr"}
+		if txSupported {
+			names = append(names, "dave", "erin")
+		}
+		if strings.Contains(resp.Body.String(), "frank") {
+			t.Errorf("Rolled back row is visible: %s", resp.Body.String())
+		}
+		for _, name := range names {
+			if !strings.Contains(resp.Body.String(), name) {
+				t.Errorf("Expected response to contain '%s', got: %s", name, resp.Body.String())
+			}
+		}
+	})
+
+	// --- STEP 5: List Databases ---
+	t.Run("5. List Databases", func(t *testing.T) {
+		resp := sendRequest("GET", "/databases", nil)
+
+		var dbs []string
+		if err := json.Unmarshal(resp.Body.Bytes(), &dbs); err != nil {
+			t.Fatalf("Invalid JSON from /databases: %v (%s)", err, resp.Body.String())
+		}
+		if len(dbs) != 1 || dbs[0] != "integration_test_db" {
+			t.Errorf("Expected [integration_test_db], got %v", dbs)
+		}
+	})
+
+	// --- STEP 6: Drop Database ---
+	t.Run("6. Drop Database", func(t *testing.T) {
+		resp := sendRequest("DELETE", "/database/drop", DBRequest{Name: "integration_test_db"})
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Drop failed. Code: %d, Body: %s", resp.Code, resp.Body.String())
+		}
+
+		resp = sendRequest("GET", "/databases", nil)
+		if strings.Contains(resp.Body.String(), "integration_test_db") {
+			t.Errorf("Database still listed after drop: %s", resp.Body.String())
 		}
 	})
 }